@@ -0,0 +1,172 @@
+package httpfstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	pathpkg "path"
+	"strings"
+	"sync"
+)
+
+// An ACLRule allows or denies a verb on the paths that match a pattern to a
+// principal.
+type ACLRule struct {
+	// Allow is whether the rule allows (or denies) matching requests.
+	Allow bool
+
+	// Path is a pattern that matches resolved paths, using the syntax of
+	// path.Match. A pattern that ends in "/**" also matches every path below
+	// the paths that match the rest of the pattern (e.g., "/builds/**"
+	// matches "/builds", "/builds/1" and "/builds/1/log").
+	Path string
+
+	// Verb is "APPEND", "FOLLOW", "DELETE", "ROTATE" or "*" (any verb).
+	Verb string
+
+	// Principal is the name of an authenticated principal, or "*" (anyone,
+	// including unauthenticated requests).
+	Principal string
+}
+
+// matches reports whether the rule applies to a request by principal (empty
+// for unauthenticated requests) to perform verb on path.
+func (r ACLRule) matches(principal, verb, path string) bool {
+	if r.Verb != "*" && r.Verb != verb {
+		return false
+	}
+	if r.Principal != "*" && (principal == "" || r.Principal != principal) {
+		return false
+	}
+	return matchPath(r.Path, path)
+}
+
+// matchPath reports whether path matches pattern, as described for
+// ACLRule.Path.
+func matchPath(pattern, path string) bool {
+	if prefix := strings.TrimSuffix(pattern, "/**"); prefix != pattern {
+		// Match prefix against as many leading segments of path as prefix
+		// has.
+		n := strings.Count(prefix, "/") + 1
+		segments := strings.Split(path, "/")
+		if len(segments) < n {
+			return false
+		}
+		pattern, path = prefix, strings.Join(segments[:n], "/")
+	}
+	ok, _ := pathpkg.Match(pattern, path)
+	return ok
+}
+
+// An ACL is an Authorizer that identifies the principal that made each
+// request and then allows or denies the request according to the first rule
+// that matches it. Requests that match no rule are denied. An ACL is safe for
+// concurrent use, and its rules may be replaced while it is in use.
+type ACL struct {
+	// Authenticator identifies principals. Requests that it doesn't
+	// authenticate (and all requests, if it is nil) are unauthenticated;
+	// they are allowed only by rules whose principal is "*".
+	Authenticator Authenticator
+
+	rules []ACLRule
+	mu    sync.RWMutex
+}
+
+// NewACL returns an ACL that identifies principals with auth and enforces
+// rules.
+func NewACL(auth Authenticator, rules []ACLRule) *ACL {
+	return &ACL{Authenticator: auth, rules: rules}
+}
+
+// SetRules replaces the ACL's rules.
+func (a *ACL) SetRules(rules []ACLRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+}
+
+// Authorize implements Authorizer. It returns ErrUnauthorized if an
+// unauthenticated request is denied (so that the client may retry with
+// credentials), and ErrForbidden if an authenticated request is denied.
+func (a *ACL) Authorize(r *http.Request, verb, path string) error {
+	var principal string
+	if a.Authenticator != nil {
+		var err error
+		principal, err = a.Authenticator.Authenticate(r)
+		if err != nil && err != ErrUnauthorized {
+			return err
+		}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, rule := range a.rules {
+		if rule.matches(principal, verb, path) {
+			if rule.Allow {
+				return nil
+			}
+			break
+		}
+	}
+	if principal == "" {
+		return ErrUnauthorized
+	}
+	return ErrForbidden
+}
+
+// Challenge returns the challenge of the ACL's Authenticator, if any.
+func (a *ACL) Challenge() string {
+	if c, ok := a.Authenticator.(challenger); ok {
+		return c.Challenge()
+	}
+	return ""
+}
+
+// ParseACLRules reads ACL rules from r. Each line contains a rule's action
+// ("allow" or "deny"), path pattern, verb and principal, separated by
+// whitespace:
+//
+//	allow /builds/**  APPEND ci
+//	allow /builds/**  FOLLOW *
+//	deny  /secrets/** *      *
+//
+// Blank lines and lines starting with "#" are ignored.
+func ParseACLRules(r io.Reader) ([]ACLRule, error) {
+	var rules []ACLRule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: want \"allow|deny path verb principal\"", line)
+		}
+		rule := ACLRule{Path: fields[1], Verb: fields[2], Principal: fields[3]}
+		switch fields[0] {
+		case "allow":
+			rule.Allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", line, fields[0])
+		}
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("line %d: path pattern %q must start with \"/\"", line, rule.Path)
+		}
+		if _, err := pathpkg.Match(rule.Path, ""); err != nil {
+			return nil, fmt.Errorf("line %d: path pattern %q: %s", line, rule.Path, err)
+		}
+		switch rule.Verb {
+		case "APPEND", "FOLLOW", "DELETE", "ROTATE", "*":
+		default:
+			return nil, fmt.Errorf("line %d: unknown verb %q", line, rule.Verb)
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
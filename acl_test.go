@@ -0,0 +1,136 @@
+package httpfstream
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testACLRules = `
+# CI may append builds, and everyone may follow them.
+allow /builds/**  APPEND ci
+allow /builds/**  FOLLOW *
+deny  /secrets/** *      *
+allow /logs/*.txt *      ops
+`
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+	rules, err := ParseACLRules(strings.NewReader(testACLRules))
+	if err != nil {
+		t.Fatalf("ParseACLRules: %s", err)
+	}
+	auth := &BearerAuth{Tokens: map[string]string{"ci-token": "ci", "ops-token": "ops"}}
+	acl := NewACL(auth, rules)
+	server := newTestServerWith(func(h *Handler) { h.Authorizer = acl })
+	defer server.close()
+
+	tests := []struct {
+		token string
+		verb  string
+		path  string
+		err   error
+	}{
+		{token: "ci-token", verb: "APPEND", path: "/builds/1"},
+		{token: "ci-token", verb: "APPEND", path: "/builds/2/log"},
+		{token: "ci-token", verb: "FOLLOW", path: "/builds/1"},
+		{verb: "FOLLOW", path: "/builds/1"},
+		{token: "ops-token", verb: "FOLLOW", path: "/builds/1"},
+		{token: "bad-token", verb: "FOLLOW", path: "/builds/1"},
+		{verb: "APPEND", path: "/builds/3", err: ErrUnauthorized},
+		{token: "ops-token", verb: "APPEND", path: "/builds/3", err: ErrForbidden},
+		{token: "ci-token", verb: "APPEND", path: "/buildsx", err: ErrForbidden},
+		{token: "ci-token", verb: "APPEND", path: "/secrets/key", err: ErrForbidden},
+		{token: "ops-token", verb: "FOLLOW", path: "/secrets/key", err: ErrForbidden},
+		{verb: "FOLLOW", path: "/secrets", err: ErrUnauthorized},
+		{token: "ops-token", verb: "APPEND", path: "/logs/a.txt"},
+		{token: "ops-token", verb: "FOLLOW", path: "/logs/a.txt"},
+		{token: "ops-token", verb: "APPEND", path: "/logs/a/b.txt", err: ErrForbidden},
+		{token: "ci-token", verb: "FOLLOW", path: "/logs/a.txt", err: ErrForbidden},
+		{token: "ops-token", verb: "FOLLOW", path: "/other", err: ErrForbidden},
+	}
+	for _, test := range tests {
+		label := test.verb + " " + test.path + " (" + test.token + ")"
+		c := &Client{}
+		if test.token != "" {
+			c.Header = http.Header{"Authorization": []string{"Bearer " + test.token}}
+		}
+		u, _ := url.Parse(server.URL + test.path)
+
+		var err error
+		switch test.verb {
+		case "APPEND":
+			err = c.Append(u, bytes.NewReader([]byte("foo")))
+		case "FOLLOW":
+			var r io.ReadCloser
+			r, err = c.Follow(u)
+			if err == nil {
+				r.Close()
+			}
+			if err == os.ErrNotExist {
+				// Allowed, but the file doesn't exist.
+				err = nil
+			}
+		}
+		if err != test.err {
+			t.Errorf("%s: want error %v, got %v", label, test.err, err)
+		}
+	}
+
+	// Reloading the rules takes effect for subsequent requests.
+	acl.SetRules([]ACLRule{{Allow: true, Path: "/**", Verb: "*", Principal: "*"}})
+	u, _ := url.Parse(server.URL + "/secrets/key")
+	if err := Append(u, bytes.NewReader([]byte("foo"))); err != nil {
+		t.Errorf("after SetRules: Append: %s", err)
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/foo", "/foo", true},
+		{"/foo", "/foo/bar", false},
+		{"/*.txt", "/a.txt", true},
+		{"/*.txt", "/a/b.txt", false},
+		{"/foo/**", "/foo", true},
+		{"/foo/**", "/foo/bar/baz", true},
+		{"/foo/**", "/foobar", false},
+		{"/*/logs/**", "/a/logs/b", true},
+		{"/*/logs/**", "/a/other/b", false},
+		{"/**", "/", true},
+		{"/**", "/a/b", true},
+	}
+	for _, test := range tests {
+		if got := matchPath(test.pattern, test.path); got != test.want {
+			t.Errorf("matchPath(%q, %q): want %v, got %v", test.pattern, test.path, test.want, got)
+		}
+	}
+}
+
+func TestParseACLRules(t *testing.T) {
+	rules, err := ParseACLRules(strings.NewReader(testACLRules))
+	if err != nil {
+		t.Fatalf("ParseACLRules: %s", err)
+	}
+	if want := (ACLRule{Allow: false, Path: "/secrets/**", Verb: "*", Principal: "*"}); len(rules) != 4 || rules[2] != want {
+		t.Errorf("want rules[2] == %+v, got %+v", want, rules)
+	}
+
+	for _, input := range []string{
+		"allow /foo APPEND\n",
+		"permit /foo APPEND ci\n",
+		"allow foo APPEND ci\n",
+		"allow /[ APPEND ci\n",
+		"allow /foo REMOVE ci\n",
+	} {
+		if _, err := ParseACLRules(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: want error", input)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package httpfstream
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/go-websocket/websocket"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AppendOptions configures an Appender.
+type AppendOptions struct {
+	// MinBackoff is the delay before the first reconnection attempt after a
+	// failure. The delay doubles after each consecutive failure, up to
+	// MaxBackoff. If zero, DefaultMinBackoff and DefaultMaxBackoff are used.
+	MinBackoff, MaxBackoff time.Duration
+
+	// MaxRetries is the maximum number of consecutive failed connection
+	// attempts before Write or Close gives up and returns the last error. If
+	// zero, the Appender retries indefinitely.
+	MaxRetries int
+
+	// Client is the client used to connect to the server. If nil,
+	// DefaultClient is used.
+	Client *Client
+}
+
+var (
+	// ErrAppenderClosed is returned by Write after the Appender is closed.
+	ErrAppenderClosed = errors.New("appender is closed")
+
+	// ErrAckUnsupported indicates that the server does not report committed
+	// file sizes, so an Appender can't determine which data to resend.
+	ErrAckUnsupported = errors.New("server does not support acknowledged appends")
+
+	// ErrFileChanged indicates that, upon reconnecting, an Appender found that
+	// the file's size is inconsistent with the data it has written (e.g.,
+	// because another writer appended to the file in the meantime).
+	ErrFileChanged = errors.New("file was modified by another writer")
+
+	// errNoProgress is returned when an Appender gives up after the server
+	// repeatedly closed the connection without acknowledging any data.
+	errNoProgress = errors.New("server repeatedly closed the connection without acknowledging data")
+)
+
+// An Appender appends data to the file at a URL, like OpenAppend, but it
+// survives transient failures. The server acknowledges each write with the
+// committed size of the file. The Appender retains data until it has been
+// acknowledged, and when the connection is lost, it reconnects (with
+// exponential backoff), asks the server for the current size of the file, and
+// resends only the data that was not committed.
+type Appender struct {
+	u   *url.URL
+	opt AppendOptions
+
+	// wmu serializes Write and Close, which write to the WebSocket.
+	wmu sync.Mutex
+
+	// mu protects the fields below. The goroutine that reads acknowledgements
+	// only acquires mu, so it never waits on a network write.
+	ws       *websocket.Conn
+	pending  []byte // written but not yet acknowledged
+	offset   int64  // offset in the file of pending[0]
+	started  bool   // whether offset has been set from the server
+	failures int
+
+	// progress is whether the server has acknowledged data on the current
+	// (or last) connection. A connection that is lost before it makes
+	// progress counts as a failure, so that data the server keeps refusing is
+	// resent only after a backoff delay.
+	progress bool
+
+	// maxSize and maxMessage are the server's limits on the size of the file
+	// and of each message, or zero if it has none.
+	maxSize, maxMessage int64
+
+	// endMarker is whether the server accepts end-of-stream markers.
+	endMarker bool
+
+	op int // type of data messages
+
+	closed bool
+	acked  *sync.Cond
+	mu     sync.Mutex
+}
+
+// NewAppender returns an Appender for the file at the given URL (which must be
+// handled by httpfstream's HTTP handler). It does not connect until the first
+// call to Write. If opt is nil, the default options are used.
+func NewAppender(u *url.URL, opt *AppendOptions) *Appender {
+	a := &Appender{u: u}
+	a.acked = sync.NewCond(&a.mu)
+	if opt != nil {
+		a.opt = *opt
+	}
+	if a.opt.MinBackoff == 0 {
+		a.opt.MinBackoff = DefaultMinBackoff
+		if a.opt.MaxBackoff == 0 {
+			a.opt.MaxBackoff = DefaultMaxBackoff
+		}
+	}
+	if a.opt.MaxBackoff < a.opt.MinBackoff {
+		a.opt.MaxBackoff = a.opt.MinBackoff
+	}
+	if a.opt.Client == nil {
+		a.opt.Client = DefaultClient
+	}
+	return a
+}
+
+// Offset returns the committed size of the file, as last acknowledged by the
+// server.
+func (a *Appender) Offset() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.offset
+}
+
+// Write implements io.Writer. When it returns, the data has been sent but not
+// necessarily committed; call Close to wait until all data is committed. It
+// returns ErrQuotaExceeded if writing p would exceed the server's limit on the
+// size of the file.
+func (a *Appender) Write(p []byte) (n int, err error) {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return 0, ErrAppenderClosed
+	}
+	if len(p) == 0 {
+		a.mu.Unlock()
+		return 0, nil
+	}
+	if a.exceedsMaxSize(int64(len(p))) {
+		a.mu.Unlock()
+		return 0, ErrQuotaExceeded
+	}
+	a.pending = append(a.pending, p...)
+	ws := a.ws
+	a.mu.Unlock()
+
+	if ws != nil {
+		if err := a.send(ws, p); err == nil {
+			return len(p), nil
+		}
+		a.disconnect(ws)
+	}
+
+	// Connecting resends all pending data, including p.
+	if _, err := a.connect(); err != nil {
+		if err == ErrQuotaExceeded {
+			// The limit wasn't known when p was checked against it, so
+			// don't keep p.
+			a.mu.Lock()
+			if len(a.pending) >= len(p) {
+				a.pending = a.pending[:len(a.pending)-len(p)]
+			}
+			a.mu.Unlock()
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// exceedsMaxSize reports whether writing n more bytes would exceed the
+// server's limit on the size of the file. The caller must hold a.mu.
+func (a *Appender) exceedsMaxSize(n int64) bool {
+	return a.maxSize > 0 && a.offset+int64(len(a.pending))+n > a.maxSize
+}
+
+// Close waits until all written data has been committed (reconnecting and
+// resending as needed) and then ends the stream successfully.
+func (a *Appender) Close() error {
+	return a.end(&streamStatus{})
+}
+
+// Abort waits until all written data has been committed (reconnecting and
+// resending as needed) and then ends the stream unsuccessfully, for the given
+// reason.
+func (a *Appender) Abort(reason string) error {
+	return a.end(&streamStatus{Aborted: true, Reason: reason})
+}
+
+func (a *Appender) end(st *streamStatus) error {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.mu.Unlock()
+
+	for {
+		a.mu.Lock()
+		ws := a.ws
+		for ws != nil && ws == a.ws && len(a.pending) > 0 {
+			ws.SetReadDeadline(time.Now().Add(readWait))
+			a.acked.Wait()
+		}
+		done := len(a.pending) == 0
+		ws = a.ws
+		endMarker := a.endMarker
+		a.mu.Unlock()
+
+		if done {
+			if ws == nil {
+				if !a.started {
+					// Nothing was ever written.
+					return nil
+				}
+				var err error
+				if ws, err = a.connect(); err != nil {
+					return err
+				}
+				continue
+			}
+			if endMarker {
+				if err := writeEndMarker(ws, st); err != nil {
+					a.disconnect(ws)
+					continue
+				}
+			}
+			ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			a.disconnect(ws)
+			return nil
+		}
+		if ws == nil {
+			if _, err := a.connect(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// connect opens a new connection, discards the pending data that the server
+// has already committed, and resends the rest. It retries (with backoff) until
+// it succeeds, the retries are exhausted, or a permanent error occurs. The
+// caller must hold a.wmu.
+func (a *Appender) connect() (*websocket.Conn, error) {
+	a.mu.Lock()
+	if a.started && !a.progress && len(a.pending) > 0 {
+		// The last connection was lost before the server acknowledged any
+		// data (e.g., because the server's storage is full).
+		a.failures++
+	}
+	failures := a.failures
+	a.mu.Unlock()
+	if a.opt.MaxRetries != 0 && failures > a.opt.MaxRetries {
+		return nil, errNoProgress
+	}
+	if failures > 0 {
+		time.Sleep(backoffDelay(a.opt.MinBackoff, a.opt.MaxBackoff, failures))
+	}
+
+	for {
+		ws, err := a.dial()
+		if err == nil {
+			return ws, nil
+		}
+		switch err {
+		case ErrAckUnsupported, ErrFileChanged, ErrUnauthorized, ErrForbidden, ErrQuotaExceeded:
+			return nil, err
+		}
+
+		a.mu.Lock()
+		a.failures++
+		failures := a.failures
+		a.mu.Unlock()
+		if a.opt.MaxRetries != 0 && failures > a.opt.MaxRetries {
+			return nil, err
+		}
+		time.Sleep(backoffDelay(a.opt.MinBackoff, a.opt.MaxBackoff, failures))
+	}
+}
+
+func (a *Appender) dial() (*websocket.Conn, error) {
+	ws, resp, err := a.opt.Client.open(context.Background(), a.u, "APPEND", http.Header{xAck: []string{"1"}, xEndMarker: []string{"1"}, xBinary: []string{"1"}})
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		if err == websocket.ErrBadHandshake {
+			if err2 := errorFromResponse(resp, nil); err2 != nil {
+				return nil, err2
+			}
+		}
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(resp.Header.Get(xOffset), 10, 64)
+	if err != nil {
+		ws.Close()
+		return nil, ErrAckUnsupported
+	}
+
+	a.mu.Lock()
+	if !a.started {
+		a.offset = size
+		a.started = true
+	}
+	committed := size - a.offset
+	if committed < 0 || committed > int64(len(a.pending)) {
+		a.mu.Unlock()
+		ws.Close()
+		return nil, ErrFileChanged
+	}
+	a.pending = a.pending[committed:]
+	a.offset = size
+	a.maxSize, a.maxMessage = sizeLimits(resp.Header)
+	if a.exceedsMaxSize(0) {
+		a.mu.Unlock()
+		ws.Close()
+		return nil, ErrQuotaExceeded
+	}
+	resend := a.pending
+	a.ws = ws
+	a.endMarker = resp.Header.Get(xEndMarker) == "1"
+	a.op = dataOp(resp.Header)
+	a.progress = committed > 0
+	if a.progress || len(resend) == 0 {
+		a.failures = 0
+	}
+	a.mu.Unlock()
+
+	go a.readAcks(ws)
+
+	if len(resend) > 0 {
+		if err := a.send(ws, resend); err != nil {
+			a.disconnect(ws)
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+func (a *Appender) send(ws *websocket.Conn, p []byte) error {
+	a.mu.Lock()
+	op, maxMessage := a.op, a.maxMessage
+	a.mu.Unlock()
+
+	_, err := writeMessages(ws, op, p, maxMessage)
+	return err
+}
+
+// readAcks reads acknowledgements from ws and discards the pending data that
+// they acknowledge.
+func (a *Appender) readAcks(ws *websocket.Conn) {
+	defer a.disconnect(ws)
+	for {
+		_, rd, err := ws.NextReader()
+		if err != nil {
+			return
+		}
+		data, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return
+		}
+		size, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		if n := size - a.offset; n > 0 && n <= int64(len(a.pending)) {
+			a.pending = a.pending[n:]
+			a.offset = size
+			a.progress = true
+			a.failures = 0
+		}
+		a.acked.Broadcast()
+		a.mu.Unlock()
+	}
+}
+
+// disconnect closes ws and, if it is the current connection, clears it so
+// that the next write reconnects.
+func (a *Appender) disconnect(ws *websocket.Conn) {
+	ws.Close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ws == ws {
+		a.ws = nil
+	}
+	a.acked.Broadcast()
+}
@@ -0,0 +1,154 @@
+package httpfstream
+
+import (
+	"context"
+	"github.com/garyburd/go-websocket/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppender(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	su, _ := url.Parse(server.URL)
+	proxy := newDropProxy(t, su.Host)
+	defer proxy.close()
+
+	pu, _ := url.Parse("http://" + proxy.Addr().String() + "/stream")
+
+	a := NewAppender(pu, &AppendOptions{MinBackoff: time.Millisecond})
+	io.WriteString(a, "abc")
+	waitForWrite()
+	if want, got := int64(3), a.Offset(); want != got {
+		t.Errorf("want acknowledged offset %d, got %d", want, got)
+	}
+
+	// Drop the connection and keep writing. The Appender should reconnect
+	// and resend whatever the server did not commit.
+	proxy.drop()
+	waitForWrite()
+	io.WriteString(a, "def")
+	io.WriteString(a, "ghi")
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if want, got := int64(9), a.Offset(); want != got {
+		t.Errorf("want acknowledged offset %d, got %d", want, got)
+	}
+
+	waitForWrite()
+	f, err := os.Open(filepath.Join(server.dir, "stream"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer f.Close()
+	if want, got := "abcdefghi", string(readAll(t, f)); want != got {
+		t.Errorf("want file data %q, got %q", want, got)
+	}
+}
+
+// TestAppender_follower checks that followers keep following a stream whose
+// Appender reconnects after its connection drops.
+func TestAppender_follower(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) { h.ResumeTimeout = 5 * time.Second })
+	defer server.close()
+
+	su, _ := url.Parse(server.URL)
+	proxy := newDropProxy(t, su.Host)
+	defer proxy.close()
+
+	u, _ := url.Parse(server.URL + "/stream")
+	pu, _ := url.Parse("http://" + proxy.Addr().String() + "/stream")
+
+	a := NewAppender(pu, &AppendOptions{MinBackoff: time.Millisecond})
+	io.WriteString(a, "abc")
+	waitForWrite()
+
+	f := NewFollower(u, nil)
+	defer f.Close()
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	for _, r := range []io.Reader{f, r} {
+		if want, got := "abc", string(limitRead(t, r, 3)); want != got {
+			t.Errorf("want data %q, got %q", want, got)
+		}
+	}
+
+	proxy.drop()
+	waitForWrite()
+	io.WriteString(a, "def")
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	for _, r := range []io.Reader{f, r} {
+		if want, got := "def", string(limitRead(t, r, 3)); want != got {
+			t.Errorf("want data %q, got %q", want, got)
+		}
+		checkEndOfStream(t, "follower", r, nil)
+	}
+}
+
+func TestAppender_existingFile(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	if err := Append(u, strings.NewReader("foo")); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	waitForWrite()
+
+	a := NewAppender(u, nil)
+	io.WriteString(a, "bar")
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if want, got := int64(6), a.Offset(); want != got {
+		t.Errorf("want acknowledged offset %d, got %d", want, got)
+	}
+	if want, got := "foobar", httpGET(t, u); want != got {
+		t.Errorf("want file data %q, got %q", want, got)
+	}
+}
+
+func TestAppender_writerConflict(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+
+	a := NewAppender(u, &AppendOptions{MinBackoff: time.Millisecond, MaxRetries: 1})
+	if _, err := io.WriteString(a, "foo"); err != ErrWriterConflict {
+		t.Errorf("want error %v, got %v", ErrWriterConflict, err)
+	}
+
+	// Older clients (which send none of the newer headers) receive HTTP 403.
+	_, resp, err := DefaultClient.open(context.Background(), u, "APPEND", nil)
+	if err != websocket.ErrBadHandshake {
+		t.Fatalf("want error %v, got %v", websocket.ErrBadHandshake, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("want HTTP 403 for older clients, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,198 @@
+package httpfstream
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// An Authorizer decides whether a request may perform an operation on a path.
+//
+// If an Authorizer also has a method Challenge() string, its result is sent in
+// the WWW-Authenticate header of responses that deny a request with
+// ErrUnauthorized.
+type Authorizer interface {
+	// Authorize returns nil if r may perform verb ("APPEND", "FOLLOW",
+	// "DELETE" or "ROTATE") on path (the resolved path of the file). Otherwise, it returns
+	// ErrUnauthorized if r lacks valid credentials (the server responds with
+	// HTTP 401), or any other error, such as ErrForbidden, if r is not allowed
+	// (HTTP 403).
+	Authorize(r *http.Request, verb, path string) error
+}
+
+// The AuthorizerFunc type is an adapter to allow the use of ordinary functions
+// as Authorizers.
+type AuthorizerFunc func(r *http.Request, verb, path string) error
+
+// Authorize implements Authorizer.
+func (f AuthorizerFunc) Authorize(r *http.Request, verb, path string) error {
+	return f(r, verb, path)
+}
+
+var (
+	// ErrUnauthorized indicates that a request lacks valid credentials. The
+	// server responds to it with HTTP 401.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden indicates that a request is not allowed. The server
+	// responds to it with HTTP 403.
+	ErrForbidden = errors.New("forbidden")
+)
+
+type challenger interface {
+	Challenge() string
+}
+
+// An Authenticator identifies the principal that made a request. BearerAuth
+// and BasicAuth are Authenticators.
+type Authenticator interface {
+	// Authenticate returns the name of the principal that made r, or
+	// ErrUnauthorized if r lacks valid credentials.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// authorize checks whether r may perform verb on path. If not, it writes an
+// error response and returns false.
+func (h Handler) authorize(w http.ResponseWriter, r *http.Request, verb, path string) bool {
+	if h.Authorizer == nil {
+		return true
+	}
+	err := h.Authorizer.Authorize(r, verb, path)
+	if err == nil {
+		return true
+	}
+	h.logInfo("Request denied", "verb", verb, "path", path, "remote_addr", r.RemoteAddr, "error", err)
+	if err == ErrUnauthorized {
+		if c, ok := h.Authorizer.(challenger); ok && c.Challenge() != "" {
+			w.Header().Set("WWW-Authenticate", c.Challenge())
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+	return false
+}
+
+// BearerAuth is an Authorizer that allows requests with an
+// "Authorization: Bearer <token>" header for one of its tokens.
+type BearerAuth struct {
+	// Tokens maps each valid token to the name of the principal that it
+	// authenticates.
+	Tokens map[string]string
+
+	// Realm is sent to clients that don't authenticate.
+	Realm string
+}
+
+// Authenticate returns the name of the principal authenticated by r's bearer
+// token, or ErrUnauthorized if r has no valid token.
+func (a *BearerAuth) Authenticate(r *http.Request) (string, error) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", ErrUnauthorized
+	}
+	token := []byte(strings.TrimSpace(auth[len(prefix):]))
+
+	// Compare against every token, in constant time, so that the response
+	// time doesn't reveal which tokens exist.
+	var principal string
+	var found bool
+	for t, p := range a.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			principal, found = p, true
+		}
+	}
+	if !found {
+		return "", ErrUnauthorized
+	}
+	return principal, nil
+}
+
+// Authorize implements Authorizer. It allows all requests with a valid token.
+func (a *BearerAuth) Authorize(r *http.Request, verb, path string) error {
+	_, err := a.Authenticate(r)
+	return err
+}
+
+// Challenge returns the value of the WWW-Authenticate header for responses
+// to requests without a valid token.
+func (a *BearerAuth) Challenge() string {
+	realm := a.Realm
+	if realm == "" {
+		realm = "httpfstream"
+	}
+	return "Bearer realm=" + strconv.Quote(realm)
+}
+
+// BasicAuth is an Authorizer that allows requests with valid HTTP Basic
+// credentials.
+type BasicAuth struct {
+	// Users maps each user name to its password.
+	Users map[string]string
+
+	// Realm is sent to clients that don't authenticate.
+	Realm string
+}
+
+// Authenticate returns the user name in r's HTTP Basic credentials, or
+// ErrUnauthorized if r has no valid credentials.
+func (a *BasicAuth) Authenticate(r *http.Request) (string, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", ErrUnauthorized
+	}
+	want, found := a.Users[user]
+	if subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 || !found {
+		return "", ErrUnauthorized
+	}
+	return user, nil
+}
+
+// Authorize implements Authorizer. It allows all requests with valid
+// credentials.
+func (a *BasicAuth) Authorize(r *http.Request, verb, path string) error {
+	_, err := a.Authenticate(r)
+	return err
+}
+
+// Challenge returns the value of the WWW-Authenticate header for responses
+// to requests without valid credentials.
+func (a *BasicAuth) Challenge() string {
+	realm := a.Realm
+	if realm == "" {
+		realm = "httpfstream"
+	}
+	return "Basic realm=" + strconv.Quote(realm)
+}
+
+// ParseTokens reads bearer tokens for BearerAuth.Tokens from r. Each line
+// contains a principal name and a token, separated by whitespace. Blank lines
+// and lines starting with "#" are ignored.
+func ParseTokens(r io.Reader) (map[string]string, error) {
+	tokens := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"principal token\"", line)
+		}
+		if _, dup := tokens[fields[1]]; dup {
+			return nil, fmt.Errorf("line %d: duplicate token", line)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
@@ -0,0 +1,139 @@
+package httpfstream
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBearerAuth(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) {
+		h.Authorizer = &BearerAuth{Tokens: map[string]string{"s3cret": "ci"}}
+	})
+	defer server.close()
+	u, _ := url.Parse(server.URL + "/file")
+
+	tests := []struct {
+		label     string
+		header    http.Header
+		wantErr   error
+		challenge string
+	}{
+		{label: "no token", wantErr: ErrUnauthorized},
+		{label: "wrong token", header: http.Header{"Authorization": []string{"Bearer wrong"}}, wantErr: ErrUnauthorized},
+		{label: "basic credentials", header: http.Header{"Authorization": []string{"Basic czNjcmV0Og=="}}, wantErr: ErrUnauthorized},
+		{label: "valid token", header: http.Header{"Authorization": []string{"Bearer s3cret"}}},
+	}
+	for _, test := range tests {
+		c := &Client{Header: test.header}
+		err := c.Append(u, bytes.NewReader([]byte("foo")))
+		if err != test.wantErr {
+			t.Errorf("%s: Append: want error %v, got %v", test.label, test.wantErr, err)
+		}
+		waitForWrite()
+		r, err := c.Follow(u)
+		if err == nil {
+			r.Close()
+		}
+		if err != test.wantErr {
+			t.Errorf("%s: Follow: want error %v, got %v", test.label, test.wantErr, err)
+		}
+	}
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET without token: want HTTP status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if want, got := `Bearer realm="httpfstream"`, resp.Header.Get("WWW-Authenticate"); want != got {
+		t.Errorf("GET without token: want WWW-Authenticate %q, got %q", want, got)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) {
+		h.Authorizer = &BasicAuth{Users: map[string]string{"alice": "pw"}, Realm: "logs"}
+	})
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	if err := Append(u, bytes.NewReader([]byte("foo"))); err != ErrUnauthorized {
+		t.Errorf("Append without credentials: want error %v, got %v", ErrUnauthorized, err)
+	}
+
+	u.User = url.UserPassword("alice", "wrong")
+	req, _ := http.NewRequest("POST", u.String(), strings.NewReader("foo"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST with wrong password: want HTTP status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if want, got := `Basic realm="logs"`, resp.Header.Get("WWW-Authenticate"); want != got {
+		t.Errorf("want WWW-Authenticate %q, got %q", want, got)
+	}
+
+	u.User = url.UserPassword("alice", "pw")
+	req, _ = http.NewRequest("POST", u.String(), strings.NewReader("foo"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST with valid credentials: want HTTP status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestAuthorizerFunc(t *testing.T) {
+	t.Parallel()
+	var paths []string
+	server := newTestServerWith(func(h *Handler) {
+		h.Authorizer = AuthorizerFunc(func(r *http.Request, verb, path string) error {
+			paths = append(paths, verb+" "+path)
+			if verb == "APPEND" {
+				return ErrForbidden
+			}
+			return nil
+		})
+	})
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	if err := Append(u, bytes.NewReader([]byte("foo"))); err != ErrForbidden {
+		t.Errorf("Append: want error %v, got %v", ErrForbidden, err)
+	}
+	if _, err := Follow(u); err != os.ErrNotExist {
+		t.Errorf("Follow: want error %v, got %v", os.ErrNotExist, err)
+	}
+	if want := []string{"APPEND /file", "FOLLOW /file"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("want authorized %v, got %v", want, paths)
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens(strings.NewReader("# CI tokens\nci abc\n\n  deploy   def  \n"))
+	if err != nil {
+		t.Fatalf("ParseTokens: %s", err)
+	}
+	if want := map[string]string{"abc": "ci", "def": "deploy"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("want %v, got %v", want, tokens)
+	}
+
+	for _, input := range []string{"abc\n", "ci abc\ndeploy abc\n", "ci abc def\n"} {
+		if _, err := ParseTokens(strings.NewReader(input)); err == nil {
+			t.Errorf("%q: want error", input)
+		}
+	}
+}
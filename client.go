@@ -1,58 +1,220 @@
 package httpfstream
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/garyburd/go-websocket/websocket"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// A Client is an httpfstream client. Its zero value (DefaultClient) is a
+// usable client that dials directly, uses the default TLS configuration and
+// sends no extra headers.
+type Client struct {
+	// Dial specifies the function for creating TCP connections (to the server
+	// or, if Proxy is set, to the proxy). If nil, a net.Dialer is used.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig specifies the TLS configuration for "https" URLs (e.g., to
+	// trust a private CA or to present a client certificate). If nil, the
+	// default configuration is used.
+	TLSConfig *tls.Config
+
+	// Proxy returns the proxy to use for a request, as
+	// http.ProxyFromEnvironment does. Connections to the server are tunneled
+	// through the proxy with HTTP CONNECT. If Proxy is nil or returns a nil
+	// URL, no proxy is used.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// Header contains extra headers (e.g., Authorization) to send with each
+	// request.
+	Header http.Header
+
+	// ReadBufferSize and WriteBufferSize are the sizes of the WebSocket I/O
+	// buffers. If zero, 10 kb buffers are used.
+	ReadBufferSize, WriteBufferSize int
+}
+
+// DefaultClient is the default Client, used by Follow, Append, OpenAppend and
+// their variants.
+var DefaultClient = &Client{}
+
+// Follow is a wrapper around DefaultClient.Follow.
+func Follow(u *url.URL) (io.ReadCloser, error) {
+	return DefaultClient.Follow(u)
+}
+
+// FollowAt is a wrapper around DefaultClient.FollowAt.
+func FollowAt(u *url.URL, offset int64) (io.ReadCloser, error) {
+	return DefaultClient.FollowAt(u, offset)
+}
+
+// FollowContext is a wrapper around DefaultClient.FollowContext.
+func FollowContext(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	return DefaultClient.FollowContext(ctx, u)
+}
+
+// FollowAtContext is a wrapper around DefaultClient.FollowAtContext.
+func FollowAtContext(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	return DefaultClient.FollowAtContext(ctx, u, offset)
+}
+
+// FollowTail is a wrapper around DefaultClient.FollowTail.
+func FollowTail(u *url.URL, n int64, lines bool) (io.ReadCloser, error) {
+	return DefaultClient.FollowTail(u, n, lines)
+}
+
+// FollowTailContext is a wrapper around DefaultClient.FollowTailContext.
+func FollowTailContext(ctx context.Context, u *url.URL, n int64, lines bool) (io.ReadCloser, error) {
+	return DefaultClient.FollowTailContext(ctx, u, n, lines)
+}
+
 // Follow opens a WebSocket to the file at the given URL (which must be handled
 // by httpfstream's HTTP handler) and returns the file's contents. The
 // io.ReadCloser continues to return data (blocking as needed) if, and as long
 // as, there is an active writer to the file.
-func Follow(u *url.URL) (io.ReadCloser, error) {
-	ws, resp, err := newClient(u, "FOLLOW")
+//
+// When the stream ends, the io.ReadCloser returns io.EOF if the writer finished
+// successfully (or did not report how it finished), or an *AbortError if the
+// writer aborted or disconnected without finishing.
+func (c *Client) Follow(u *url.URL) (io.ReadCloser, error) {
+	return c.FollowAtContext(context.Background(), u, 0)
+}
+
+// FollowAt is like Follow, but it skips the first offset bytes of the file's
+// contents. It returns ErrOffsetOutOfRange if offset is greater than the size
+// of the file.
+func (c *Client) FollowAt(u *url.URL, offset int64) (io.ReadCloser, error) {
+	return c.FollowAtContext(context.Background(), u, offset)
+}
+
+// FollowContext is like Follow, but if ctx is done before the stream ends, it
+// cancels connecting (or, once connected, closes the connection), and the call
+// or the pending and subsequent reads return ctx.Err().
+func (c *Client) FollowContext(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	return c.FollowAtContext(ctx, u, 0)
+}
+
+// FollowAtContext is like FollowAt, but it is canceled by ctx as described for
+// FollowContext.
+func (c *Client) FollowAtContext(ctx context.Context, u *url.URL, offset int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if offset != 0 {
+		header.Set(xOffset, strconv.FormatInt(offset, 10))
+	}
+	return c.follow(ctx, u, header)
+}
+
+// FollowTail is like Follow, but it skips all but the last n bytes of the
+// file's contents, or all but the last n lines if lines is true (like tail -c
+// and tail -n). A newline at the end of the contents doesn't start another
+// line.
+func (c *Client) FollowTail(u *url.URL, n int64, lines bool) (io.ReadCloser, error) {
+	return c.FollowTailContext(context.Background(), u, n, lines)
+}
+
+// FollowTailContext is like FollowTail, but it is canceled by ctx as described
+// for FollowContext.
+func (c *Client) FollowTailContext(ctx context.Context, u *url.URL, n int64, lines bool) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if lines {
+		header.Set(xTailLines, strconv.FormatInt(n, 10))
+	} else {
+		header.Set(xTailBytes, strconv.FormatInt(n, 10))
+	}
+	return c.follow(ctx, u, header)
+}
+
+// follow sends a FOLLOW request with the given extra headers.
+func (c *Client) follow(ctx context.Context, u *url.URL, header http.Header) (io.ReadCloser, error) {
+	header.Set(xEndMarker, "1")
+	header.Set(xBinary, "1")
+	ws, resp, err := c.open(ctx, u, "FOLLOW", header)
 	if err == websocket.ErrBadHandshake {
-		err = errorFromResponse(resp, nil)
+		if err = errorFromResponse(resp, nil); err != nil {
+			resp.Body.Close()
+		}
 	}
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode == http.StatusOK {
-		return resp.Body, nil
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return &statusReadCloser{resp}, nil
 	}
 
-	return &webSocketReadCloser{ws}, nil
+	return &webSocketReadCloser{ws: ws, op: dataOp(resp.Header), endMarker: resp.Header.Get(xEndMarker) == "1"}, nil
 }
 
 type webSocketReadCloser struct {
 	ws *websocket.Conn
+	op int // type of data messages
+
+	// endMarker is whether the server sends end-of-stream markers.
+	endMarker bool
+
+	rdr   io.Reader // reader for the current message
+	rdrOp int       // type of the current message
+	empty bool      // whether no data has been read from rdr
+	err   error     // error to return after the end of the stream
 }
 
 // Read implements io.Reader.
 func (r *webSocketReadCloser) Read(p []byte) (n int, err error) {
-	op, rdr, err := r.ws.NextReader()
-	if err != nil {
-		return 0, err
+	if r.err != nil {
+		return 0, r.err
 	}
-	if op != websocket.OpText {
-		return 0, errors.New("websocket op is not text")
-	}
-	n, err = rdr.Read(p)
+	for {
+		if r.rdr == nil {
+			op, rdr, err := r.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if op != websocket.OpText && op != websocket.OpBinary {
+				return 0, errors.New("websocket op is not text or binary")
+			}
+			r.rdr, r.rdrOp, r.empty = rdr, op, true
+		}
 
-	if err == io.EOF {
-		return r.Read(p)
+		n, err = r.rdr.Read(p)
+		if n > 0 {
+			r.empty = false
+		}
+		if err != io.EOF {
+			return n, err
+		}
+
+		// Finished reading the current message.
+		empty := r.empty
+		r.rdr = nil
+		if n > 0 {
+			return n, nil
+		}
+		if empty && r.endMarker && isEndMarker(r.rdrOp, r.op, 0) {
+			st, err := readEndStatus(r.ws)
+			if err != nil {
+				return 0, err
+			}
+			r.err = st.err()
+			if r.err == nil {
+				r.err = io.EOF
+			}
+			return 0, r.err
+		}
 	}
-	return
 }
 
 // Close implements io.Closer.
@@ -60,23 +222,75 @@ func (r *webSocketReadCloser) Close() error {
 	return r.ws.Close()
 }
 
-// Append appends data from r to the file at the given URL.
+// Append is a wrapper around DefaultClient.Append.
 func Append(u *url.URL, r io.Reader) error {
-	w, err := OpenAppend(u)
+	return DefaultClient.Append(u, r)
+}
+
+// AppendContext is a wrapper around DefaultClient.AppendContext.
+func AppendContext(ctx context.Context, u *url.URL, r io.Reader) error {
+	return DefaultClient.AppendContext(ctx, u, r)
+}
+
+// Append appends data from r to the file at the given URL.
+func (c *Client) Append(u *url.URL, r io.Reader) error {
+	return c.AppendContext(context.Background(), u, r)
+}
+
+// AppendContext is like Append, but if ctx is done before all of the data is
+// appended, it cancels connecting (or, once connected, closes the connection,
+// which the server records as an aborted stream) and returns ctx.Err().
+func (c *Client) AppendContext(ctx context.Context, u *url.URL, r io.Reader) error {
+	w, err := c.OpenAppendContext(ctx, u)
 	if err != nil {
 		return err
 	}
 	defer w.Close()
 
 	_, err = io.Copy(w, r)
-	return err
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		w.Abort(err.Error())
+		return err
+	}
+	return w.Close()
+}
+
+// A StreamWriter writes to a file. Closing it ends the stream successfully,
+// and aborting it ends the stream with an error (which followers receive as an
+// *AbortError).
+type StreamWriter interface {
+	io.WriteCloser
+
+	// Abort ends the stream unsuccessfully, for the given reason.
+	Abort(reason string) error
+}
+
+// OpenAppend is a wrapper around DefaultClient.OpenAppend.
+func OpenAppend(u *url.URL) (StreamWriter, error) {
+	return DefaultClient.OpenAppend(u)
+}
+
+// OpenAppendContext is a wrapper around DefaultClient.OpenAppendContext.
+func OpenAppendContext(ctx context.Context, u *url.URL) (StreamWriter, error) {
+	return DefaultClient.OpenAppendContext(ctx, u)
 }
 
 // OpenAppend opens a WebSocket to the file at the given URL (which must point
-// be handled by httpfstream's HTTP handler) and returns an io.WriteCloser that writes
-// (via the WebSocket) to that file.
-func OpenAppend(u *url.URL) (io.WriteCloser, error) {
-	ws, resp, err := newClient(u, "APPEND")
+// be handled by httpfstream's HTTP handler) and returns a StreamWriter that
+// writes (via the WebSocket) to that file.
+func (c *Client) OpenAppend(u *url.URL) (StreamWriter, error) {
+	return c.OpenAppendContext(context.Background(), u)
+}
+
+// OpenAppendContext is like OpenAppend, but if ctx is done before the
+// StreamWriter is closed, it cancels connecting (or, once connected, closes
+// the connection, which the server records as an aborted stream), and the call
+// or the pending and subsequent writes return ctx.Err().
+func (c *Client) OpenAppendContext(ctx context.Context, u *url.URL) (StreamWriter, error) {
+	ws, resp, err := c.open(ctx, u, "APPEND", http.Header{xEndMarker: []string{"1"}, xBinary: []string{"1"}})
 	if resp != nil {
 		defer resp.Body.Close()
 	}
@@ -91,65 +305,510 @@ func OpenAppend(u *url.URL) (io.WriteCloser, error) {
 		return nil, err
 	}
 
-	return &appendWriteCloser{new(bytes.Buffer), ws}, nil
+	pw := &appendWriteCloser{
+		Writer:    new(bytes.Buffer),
+		ws:        ws,
+		op:        dataOp(resp.Header),
+		endMarker: resp.Header.Get(xEndMarker) == "1",
+	}
+	pw.size, _ = strconv.ParseInt(resp.Header.Get(xOffset), 10, 64)
+	pw.maxSize, pw.maxMessage = sizeLimits(resp.Header)
+	pw.readDone = make(chan struct{})
+	go pw.readClose()
+	return pw, nil
+}
+
+// sizeLimits returns the limits on the size of the file and of each message
+// that the server reported in the WebSocket handshake response to an APPEND
+// request. Zero means no limit.
+func sizeLimits(header http.Header) (maxSize, maxMessage int64) {
+	maxSize, _ = strconv.ParseInt(header.Get(xMaxSize), 10, 64)
+	maxMessage, _ = strconv.ParseInt(header.Get(xMaxMessageSize), 10, 64)
+	return maxSize, maxMessage
+}
+
+// writeMessages writes p to ws in messages of type op, each of which is at
+// most maxMessage bytes long (or, if maxMessage is zero, in a single message).
+// If p is empty, it writes nothing, because an empty message may be read as an
+// end-of-stream marker.
+func writeMessages(ws *websocket.Conn, op int, p []byte, maxMessage int64) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		chunk := p[n:]
+		if maxMessage > 0 && int64(len(chunk)) > maxMessage {
+			chunk = chunk[:maxMessage]
+		}
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+		w, err := ws.NextWriter(op)
+		if err != nil {
+			return n, err
+		}
+		m, err := w.Write(chunk)
+		n += m
+		if err2 := w.Close(); err == nil {
+			err = err2
+		}
+		if err != nil || n == len(p) {
+			return n, err
+		}
+	}
 }
 
 type appendWriteCloser struct {
 	io.Writer
 	ws *websocket.Conn
+	op int // type of data messages
+
+	// endMarker is whether the server accepts end-of-stream markers.
+	endMarker bool
+
+	// size is the size of the file, including the data written so far. If
+	// the server limits the size of the file or of each message, maxSize and
+	// maxMessage are the limits.
+	size, maxSize, maxMessage int64
+
+	// readDone is closed when readClose returns. refused is set if the
+	// server refused data that exceeded a limit.
+	readDone chan struct{}
+	mu       sync.Mutex
+	refused  *QuotaError
+
+	closed bool
 }
 
-// Write implements io.Writer.
+// readClose reads messages from the server until the WebSocket is closed. The
+// server only sends an end-of-stream marker, when it refuses data that exceeded
+// a limit; readClose records the reason.
+func (pw *appendWriteCloser) readClose() {
+	defer close(pw.readDone)
+	for {
+		op, rdr, err := pw.ws.NextReader()
+		if err != nil {
+			return
+		}
+		n, err := io.Copy(ioutil.Discard, rdr)
+		if err != nil {
+			return
+		}
+		if !pw.endMarker || !isEndMarker(op, websocket.OpBinary, n) {
+			continue
+		}
+		st, err := readEndStatus(pw.ws)
+		if err != nil {
+			return
+		}
+		if st.Aborted {
+			pw.mu.Lock()
+			pw.refused = &QuotaError{Reason: st.Reason}
+			pw.mu.Unlock()
+		}
+	}
+}
+
+// refusedErr returns the error with which the server refused data, or nil.
+func (pw *appendWriteCloser) refusedErr() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.refused == nil {
+		return nil
+	}
+	return pw.refused
+}
+
+// Write implements io.Writer. It returns ErrQuotaExceeded if writing p would
+// exceed the server's limit on the size of the file, or a *QuotaError once the
+// server has refused data that exceeded a limit.
 func (pw *appendWriteCloser) Write(p []byte) (n int, err error) {
-	pw.ws.SetWriteDeadline(time.Now().Add(writeWait))
-	w, err := pw.ws.NextWriter(websocket.OpText)
-	if err != nil {
+	if err := pw.refusedErr(); err != nil {
 		return 0, err
 	}
-	defer w.Close()
-	return w.Write(p)
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if pw.maxSize > 0 && pw.size+int64(len(p)) > pw.maxSize {
+		return 0, ErrQuotaExceeded
+	}
+	n, err = writeMessages(pw.ws, pw.op, p, pw.maxMessage)
+	pw.size += int64(n)
+	if err != nil {
+		if err2 := pw.refusedErr(); err2 != nil {
+			err = err2
+		}
+	}
+	return n, err
 }
 
-// Write implements io.Closer.
+// Close implements io.Closer. If the server refused data that exceeded a limit,
+// it returns a *QuotaError.
 func (pw *appendWriteCloser) Close() error {
-	return pw.ws.Close()
+	return pw.end(&streamStatus{})
 }
 
-func newClient(u *url.URL, method string) (*websocket.Conn, *http.Response, error) {
-	var c net.Conn
+// Abort implements StreamWriter.
+func (pw *appendWriteCloser) Abort(reason string) error {
+	return pw.end(&streamStatus{Aborted: true, Reason: reason})
+}
+
+func (pw *appendWriteCloser) end(st *streamStatus) error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
 	var err error
-	hostport := hostPort(u)
-	switch u.Scheme {
-	case "http":
-		c, err = net.Dial("tcp", hostport)
-	case "https":
-		c, err = tls.Dial("tcp", hostport, nil)
-	default:
-		return nil, nil, errors.New("unrecognized URL scheme")
+	if pw.endMarker {
+		err = writeEndMarker(pw.ws, st)
 	}
+	if err == nil {
+		// Wait for the server to close the WebSocket, so that a refusal
+		// of the last data isn't missed.
+		pw.ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+		select {
+		case <-pw.readDone:
+		case <-time.After(writeWait):
+		}
+	}
+	if err2 := pw.ws.Close(); err == nil {
+		err = err2
+	}
+	if err2 := pw.refusedErr(); err2 != nil {
+		err = err2
+	}
+	return err
+}
+
+// Delete is a wrapper around DefaultClient.Delete.
+func Delete(u *url.URL) error {
+	return DefaultClient.Delete(u)
+}
+
+// Rotate is a wrapper around DefaultClient.Rotate.
+func Rotate(u *url.URL) (archive *url.URL, err error) {
+	return DefaultClient.Rotate(u)
+}
+
+// Delete deletes the file at the given URL. It returns ErrWriterConflict if
+// the file has an active writer.
+func (c *Client) Delete(u *url.URL) error {
+	resp, err := c.do("DELETE", u, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rotate archives the file at the given URL under a new name and replaces it
+// with an empty file. It returns the URL of the archive, or ErrWriterConflict
+// if the file has an active writer.
+func (c *Client) Rotate(u *url.URL) (archive *url.URL, err error) {
+	resp, err := c.do("POST", u, "ROTATE")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return u.Parse(strings.TrimSpace(string(data)))
+}
+
+// do sends a plain HTTP request (not a WebSocket) with the given method and
+// verb to u, and returns the response if its status is HTTP 2xx.
+func (c *Client) do(method string, u *url.URL, verb string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), nil)
 	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if verb != "" {
+		req.Header.Set(xVerb, verb)
+	}
+
+	transport := &http.Transport{
+		Proxy:             c.Proxy,
+		DialContext:       c.dial,
+		TLSClientConfig:   c.TLSConfig,
+		DisableKeepAlives: true,
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		if err := errorFromResponse(resp, nil); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("HTTP status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// open opens a WebSocket to u for the given verb. If ctx is done before the
+// returned connection is closed, the connection is closed and its pending and
+// subsequent reads and writes return ctx.Err(). If the server does not upgrade
+// the connection (websocket.ErrBadHandshake), the response body reads from the
+// connection, and closing it closes the connection.
+func (c *Client) open(ctx context.Context, u *url.URL, method string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, err := c.connect(ctx, u)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
 		return nil, nil, err
 	}
-	return websocket.NewClient(c, u, http.Header{xVerb: []string{method}}, readBufSize, writeBufSize)
+	conn = newContextConn(ctx, conn)
+	h := http.Header{xVerb: []string{method}}
+	for k, v := range c.Header {
+		h[k] = v
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	ws, resp, err := websocket.NewClient(conn, u, h, bufSize(c.ReadBufferSize, readBufSize), bufSize(c.WriteBufferSize, writeBufSize))
+	if err == websocket.ErrBadHandshake {
+		resp.Body = &connBody{resp.Body, conn}
+	} else if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return ws, resp, err
+}
+
+// connect opens a connection to the server at u (through the proxy, if any)
+// and, for "https" URLs, performs the TLS handshake.
+func (c *Client) connect(ctx context.Context, u *url.URL) (net.Conn, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unrecognized URL scheme")
+	}
+	hostport := hostPort(u)
+
+	var proxy *url.URL
+	if c.Proxy != nil {
+		var err error
+		proxy, err = c.Proxy(&http.Request{Method: "GET", URL: u, Header: make(http.Header), Host: u.Host})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = c.dialProxy(ctx, proxy, hostport)
+	} else {
+		conn, err = c.dial(ctx, "tcp", hostport)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "https" {
+		config := c.TLSConfig
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
 }
 
+func (c *Client) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c.Dial != nil {
+		return c.Dial(ctx, network, addr)
+	}
+	return new(net.Dialer).DialContext(ctx, network, addr)
+}
+
+// dialProxy opens a tunnel to addr through the HTTP proxy at proxy, using the
+// CONNECT method.
+func (c *Client) dialProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	if proxy.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := c.dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Read the response one byte at a time, so that no data from the tunnel
+	// is buffered.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT: HTTP status %d", resp.StatusCode)
+	}
+	return conn, nil
+}
+
+// oneByteReader reads at most one byte at a time from R.
+type oneByteReader struct{ R io.Reader }
+
+func (r oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return r.R.Read(p)
+}
+
+// closeOnDone closes c if ctx is done before stop is called.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func bufSize(size, defaultSize int) int {
+	if size <= 0 {
+		return defaultSize
+	}
+	return size
+}
+
+// contextConn is a net.Conn that is closed when its context is done, after
+// which its Read and Write methods return the context's error.
+type contextConn struct {
+	net.Conn
+	ctx  context.Context
+	stop func()
+	once sync.Once
+}
+
+func newContextConn(ctx context.Context, c net.Conn) net.Conn {
+	if ctx.Done() == nil {
+		// ctx is never canceled.
+		return c
+	}
+	return &contextConn{Conn: c, ctx: ctx, stop: closeOnDone(ctx, c)}
+}
+
+// Read implements io.Reader.
+func (c *contextConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	return n, c.err(err)
+}
+
+// Write implements io.Writer.
+func (c *contextConn) Write(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	return n, c.err(err)
+}
+
+// Close implements io.Closer.
+func (c *contextConn) Close() error {
+	c.once.Do(c.stop)
+	return c.Conn.Close()
+}
+
+func (c *contextConn) err(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+// connBody is the body of a response that was not upgraded to a WebSocket.
+// Closing it closes the connection that it reads from.
+type connBody struct {
+	io.ReadCloser
+	c net.Conn
+}
+
+// Close implements io.Closer.
+func (b *connBody) Close() error {
+	// Close the connection first so that closing the body doesn't wait for
+	// the rest of a live stream.
+	err := b.c.Close()
+	b.ReadCloser.Close()
+	return err
+}
+
+// hostPort returns the host and port of the server at u, with the scheme's
+// default port if u has none.
 func hostPort(u *url.URL) string {
-	if strings.Contains(u.Host, ":") {
-		return u.Host
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
 	}
-	return u.Host + ":" + u.Scheme
+	return net.JoinHostPort(u.Hostname(), port)
 }
 
+// ErrOffsetOutOfRange indicates that the requested offset is beyond the end of
+// the file.
+var ErrOffsetOutOfRange = errors.New("offset is beyond the end of the file")
+
 // errorFromResponse returns err if err != nil, or another non-nil error if resp
-// indicates a non-HTTP 200 response.
+// indicates a non-HTTP 200 (or 206) response.
 func errorFromResponse(resp *http.Response, err error) error {
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return ErrUnauthorized
+		case http.StatusForbidden:
+			return ErrForbidden
 		case http.StatusNotFound:
 			return os.ErrNotExist
+		case http.StatusConflict:
+			return ErrWriterConflict
+		case http.StatusRequestedRangeNotSatisfiable:
+			return ErrOffsetOutOfRange
+		case http.StatusRequestEntityTooLarge:
+			return ErrQuotaExceeded
 		default:
 			return fmt.Errorf("HTTP status %d", resp.StatusCode)
 		}
@@ -1,17 +1,27 @@
 package httpfstream
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
 
 type followTest struct {
 	path       string
+	offset     int64
 	body       string
 	writeFiles map[string]string
 	err        error
@@ -22,6 +32,9 @@ func TestFollow(t *testing.T) {
 
 	tests := []followTest{
 		{path: "/foo1", body: "bar", writeFiles: map[string]string{"/foo1": "bar"}},
+		{path: "/foo2", offset: 1, body: "ar", writeFiles: map[string]string{"/foo2": "bar"}},
+		{path: "/foo3", offset: 3, body: "", writeFiles: map[string]string{"/foo3": "bar"}},
+		{path: "/foo4", offset: 4, writeFiles: map[string]string{"/foo4": "bar"}, err: ErrOffsetOutOfRange},
 
 		{path: "/doesntexist", err: os.ErrNotExist},
 	}
@@ -53,12 +66,12 @@ func testFollow(t *testing.T, test followTest) {
 	}
 
 	u, _ := url.Parse(server.URL + test.path)
-	r, err := Follow(u)
+	r, err := FollowAt(u, test.offset)
 	if err == nil {
 		defer r.Close()
 	}
 	if test.err != err {
-		t.Errorf("%s: Follow: want error %v, got %v", label, test.err, err)
+		t.Errorf("%s: FollowAt: want error %v, got %v", label, test.err, err)
 		return
 	}
 	if test.err != nil {
@@ -128,6 +141,316 @@ func testAppend(t *testing.T, test appendTest) {
 	}
 }
 
+func TestFollowContext(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	w.Write([]byte("foo"))
+	waitForWrite()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := FollowContext(ctx, u)
+	if err != nil {
+		t.Fatalf("FollowContext: %s", err)
+	}
+	defer r.Close()
+	if data := limitRead(t, r, 3); string(data) != "foo" {
+		t.Errorf("want %q, got %q", "foo", data)
+	}
+
+	// Cancel a blocked read.
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := r.Read(make([]byte, 1)); err != context.Canceled {
+		t.Errorf("Read: want error %v, got %v", context.Canceled, err)
+	}
+
+	if _, err := FollowContext(ctx, u); err != context.Canceled {
+		t.Errorf("FollowContext with done context: want error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestFollowContext_handshake(t *testing.T) {
+	t.Parallel()
+
+	// A server that accepts connections but never responds. It reads from
+	// each connection until the client gives up and closes it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		}
+	}()
+
+	u, _ := url.Parse("http://" + l.Addr().String() + "/file")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := FollowContext(ctx, u); err != context.DeadlineExceeded {
+		t.Errorf("FollowContext: want error %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestOpenAppendContext(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := OpenAppendContext(ctx, u)
+	if err != nil {
+		t.Fatalf("OpenAppendContext: %s", err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	waitForWrite()
+
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if data := limitRead(t, r, 3); string(data) != "foo" {
+		t.Errorf("want %q, got %q", "foo", data)
+	}
+
+	cancel()
+	waitForWrite()
+	if _, err := w.Write([]byte("bar")); err != context.Canceled {
+		t.Errorf("Write after cancel: want error %v, got %v", context.Canceled, err)
+	}
+
+	// The server treats the closed connection as a disconnected writer.
+	checkEndOfStream(t, "follower", r, &AbortError{Reason: "writer disconnected"})
+
+	if err := AppendContext(ctx, u, bytes.NewReader([]byte("baz"))); err != context.Canceled {
+		t.Errorf("AppendContext with done context: want error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestClient_header(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "httpfstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var tokens []string
+	h := New(dir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := &Client{Header: http.Header{"Authorization": []string{"Bearer t0k3n"}}}
+	u, _ := url.Parse(server.URL + "/file")
+	if err := c.Append(u, bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	waitForWrite()
+	r, err := c.Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if data := readAll(t, r); string(data) != "foo" {
+		t.Errorf("want %q, got %q", "foo", data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) != 2 {
+		t.Fatalf("want 2 requests, got %d", len(tokens))
+	}
+	for _, token := range tokens {
+		if token != "Bearer t0k3n" {
+			t.Errorf("want Authorization header %q, got %q", "Bearer t0k3n", token)
+		}
+	}
+}
+
+func TestClient_TLS(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "httpfstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewTLSServer(New(dir))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	if _, err := OpenAppend(u); err == nil {
+		t.Errorf("OpenAppend: want error verifying the server's certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	c := &Client{TLSConfig: &tls.Config{RootCAs: roots}}
+	w, err := c.OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	w.Write([]byte("foo"))
+	waitForWrite()
+
+	r, err := c.Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if data := limitRead(t, r, 3); string(data) != "foo" {
+		t.Errorf("want %q, got %q", "foo", data)
+	}
+	w.Close()
+	checkEndOfStream(t, "follower", r, nil)
+}
+
+func TestClient_proxy(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	// A proxy that tunnels CONNECT requests and records their targets.
+	var mu sync.Mutex
+	var targets, auths []string
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != "CONNECT" {
+					return
+				}
+				mu.Lock()
+				targets = append(targets, req.Host)
+				auths = append(auths, req.Header.Get("Proxy-Authorization"))
+				mu.Unlock()
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+				go io.Copy(target, c)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+
+	proxyURL, _ := url.Parse("http://user:pass@" + l.Addr().String())
+	var dials []string
+	c := &Client{
+		Proxy: http.ProxyURL(proxyURL),
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials = append(dials, addr)
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+		ReadBufferSize:  64,
+		WriteBufferSize: 64,
+	}
+	u, _ := url.Parse(server.URL + "/file")
+	data := bytes.Repeat([]byte("foo"), 100)
+	if err := c.Append(u, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	waitForWrite()
+	r, err := c.Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if got := readAll(t, r); !bytes.Equal(got, data) {
+		t.Errorf("want %q, got %q", data, got)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	host := u.Host
+	if len(targets) != 2 || targets[0] != host || targets[1] != host {
+		t.Errorf("want proxy targets [%s %s], got %v", host, host, targets)
+	}
+	if want := "Basic dXNlcjpwYXNz"; len(auths) != 2 || auths[0] != want {
+		t.Errorf("want Proxy-Authorization %q, got %v", want, auths)
+	}
+	if len(dials) != 2 || dials[0] != l.Addr().String() {
+		t.Errorf("want 2 dials to the proxy, got %v", dials)
+	}
+}
+
+// TestClient_proxyDefaultPort checks that the CONNECT target of a URL without a
+// port has the scheme's default port, which proxies require.
+func TestClient_proxyDefaultPort(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	targets := make(chan string, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(c))
+			if err == nil {
+				targets <- req.Host
+			}
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			c.Close()
+		}
+	}()
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	c := &Client{Proxy: http.ProxyURL(proxyURL)}
+	for _, test := range []struct{ url, target string }{
+		{"http://example.com/file", "example.com:80"},
+		{"http://[::1]/file", "[::1]:80"},
+	} {
+		u, _ := url.Parse(test.url)
+		if _, err := c.Follow(u); err == nil {
+			t.Errorf("%s: Follow: want error from proxy", test.url)
+		}
+		if target := <-targets; target != test.target {
+			t.Errorf("%s: want CONNECT target %s, got %s", test.url, test.target, target)
+		}
+	}
+}
+
 type slowReader struct {
 	R         io.Reader
 	Wait      time.Duration
@@ -158,10 +481,12 @@ func TestHostPort(t *testing.T) {
 		input    string
 		expected string
 	}{
-		{"http://example.com", "example.com:http"},
-		{"https://example.com", "example.com:https"},
+		{"http://example.com", "example.com:80"},
+		{"https://example.com", "example.com:443"},
 		{"http://example.com:1234", "example.com:1234"},
 		{"https://example.com:1234", "example.com:1234"},
+		{"http://[::1]", "[::1]:80"},
+		{"https://[::1]:1234", "[::1]:1234"},
 	}
 
 	for _, test := range tests {
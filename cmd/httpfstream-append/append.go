@@ -4,12 +4,16 @@ import (
 	"flag"
 	"fmt"
 	"github.com/sourcegraph/httpfstream"
+	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 )
 
 var verbose = flag.Bool("v", false, "show verbose output")
+var retry = flag.Bool("retry", false, "reconnect and resend uncommitted data after network failures")
+var token = flag.String("token", "", "send this bearer token to authenticate to the server")
 
 func main() {
 	flag.Usage = func() {
@@ -33,6 +37,10 @@ func main() {
 
 	log.SetFlags(0)
 
+	if *token != "" {
+		httpfstream.DefaultClient.Header = http.Header{"Authorization": []string{"Bearer " + *token}}
+	}
+
 	urlstr := flag.Arg(0)
 	u, err := url.Parse(urlstr)
 	if err != nil {
@@ -43,7 +51,15 @@ func main() {
 		log.Printf("appending from stdin to %s", u)
 	}
 
-	err = httpfstream.Append(u, os.Stdin)
+	if *retry {
+		a := httpfstream.NewAppender(u, nil)
+		_, err = io.Copy(a, os.Stdin)
+		if err == nil {
+			err = a.Close()
+		}
+	} else {
+		err = httpfstream.Append(u, os.Stdin)
+	}
 	if err != nil {
 		log.Fatalf("failed to append from stdin to %s: %s", u, err)
 	}
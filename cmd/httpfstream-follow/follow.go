@@ -6,11 +6,16 @@ import (
 	"github.com/sourcegraph/httpfstream"
 	"io"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 )
 
 var verbose = flag.Bool("v", false, "show verbose output")
+var offset = flag.Int64("offset", 0, "start following at this byte offset")
+var tailLines = flag.Int64("n", -1, "start following at the last `N` lines, like tail -n (but without tail's +N form)")
+var tailBytes = flag.Int64("c", -1, "start following at the last `N` bytes, like tail -c (but without tail's +N form)")
+var token = flag.String("token", "", "send this bearer token to authenticate to the server")
 
 func main() {
 	flag.Usage = func() {
@@ -24,6 +29,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Example usage:\n\n")
 		fmt.Fprintf(os.Stderr, "\tTo follow data being written to http://localhost:8080/foo.txt by an httpfstream appender:\n")
 		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-follow http://localhost:8080/foo.txt\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo print the last 10 lines of http://localhost:8080/foo.txt and follow new data:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-follow -n 10 http://localhost:8080/foo.txt\n\n")
+		fmt.Fprintf(os.Stderr, "\t-n and -c count from the end of the file. Unlike tail, they don't accept +N;\n")
+		fmt.Fprintf(os.Stderr, "\tto start at a byte offset from the beginning, use -offset instead.\n\n")
 		fmt.Fprintln(os.Stderr)
 		os.Exit(1)
 	}
@@ -34,6 +43,17 @@ func main() {
 
 	log.SetFlags(0)
 
+	if *tailLines != -1 && *tailBytes != -1 {
+		log.Fatal("-n and -c are mutually exclusive")
+	}
+	if *offset != 0 && (*tailLines != -1 || *tailBytes != -1) {
+		log.Fatal("-offset can't be combined with -n or -c")
+	}
+
+	if *token != "" {
+		httpfstream.DefaultClient.Header = http.Header{"Authorization": []string{"Bearer " + *token}}
+	}
+
 	urlstr := flag.Arg(0)
 	u, err := url.Parse(urlstr)
 	if err != nil {
@@ -44,7 +64,15 @@ func main() {
 		log.Printf("following data at %s (ctrl-C to exit)", u)
 	}
 
-	r, err := httpfstream.Follow(u)
+	var r io.ReadCloser
+	switch {
+	case *tailLines != -1:
+		r, err = httpfstream.FollowTail(u, *tailLines, true)
+	case *tailBytes != -1:
+		r, err = httpfstream.FollowTail(u, *tailBytes, false)
+	default:
+		r, err = httpfstream.FollowAt(u, *offset)
+	}
 	if err != nil {
 		log.Fatalf("failed to begin following %s: %s", u, err)
 	}
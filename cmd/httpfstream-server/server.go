@@ -5,12 +5,32 @@ import (
 	"fmt"
 	"github.com/sourcegraph/httpfstream"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var bindAddr = flag.String("http", ":8080", "HTTP bind address for server")
+var metricsAddr = flag.String("metrics-http", "", "HTTP bind address for Prometheus metrics (disabled if empty)")
 var root = flag.String("root", "/tmp/httpfstream", "storage root directory")
+var aclFile = flag.String("acl", "", "enforce the access rules in this file (reloaded on SIGHUP)")
+var maxAge = flag.Duration("max-age", 0, "delete streams not modified for this long (0 for no limit)")
+var maxBytes = flag.Int64("max-bytes", 0, "delete the oldest streams while all streams total more than this many bytes (0 for no limit)")
+var maxStreams = flag.Int("max-streams", 0, "delete the oldest streams while there are more than this many (0 for no limit)")
+var gcInterval = flag.Duration("gc-interval", time.Minute, "how often to enforce -max-age, -max-bytes and -max-streams")
+var streamQuota = flag.Int64("stream-quota", 0, "refuse appends that would make a stream larger than this many bytes (0 for no limit)")
+var totalQuota = flag.Int64("total-quota", 0, "refuse appends that would make all streams total more than this many bytes (0 for no limit)")
+var maxMessage = flag.Int64("max-message", 0, "refuse WebSocket messages from appenders larger than this many bytes (0 for no limit)")
+var followerBuffer = flag.Int("follower-buffer", 0, "number of appended messages buffered for each follower (0 for the default)")
+var slowFollowers = flag.String("slow-followers", "resync", "what to do with followers that fall behind: resync (from the file), disconnect or block")
+var slowFollowerTimeout = flag.Duration("slow-follower-timeout", httpfstream.DefaultSlowFollowerTimeout, "how long to block each append for slow followers (with -slow-followers=block); at worst, every append waits this long, however many followers are slow")
+var resumeTimeout = flag.Duration("resume-timeout", 0, "how long to keep a stream open for its appender to reconnect, which delays the abort of crashed streams (0 to abort them immediately)")
+var tailBuffer = flag.Int("tail-buffer", 64*1024, "bytes of recently appended data kept in memory for each active stream (0 to disable)")
+var debug = flag.Bool("debug", false, "log debug messages")
+var tokenFile = flag.String("tokens", "", "require bearer tokens listed in this file (each line is \"principal token\")")
 
 func main() {
 	flag.Usage = func() {
@@ -24,6 +44,16 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Example usage:\n\n")
 		fmt.Fprintf(os.Stderr, "\tTo run on http://localhost:8080:\n")
 		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-server -http=:8080\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo require clients to send a bearer token from tokens.txt:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-server -tokens=tokens.txt\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo also enforce access rules (each line is \"allow|deny path verb principal\"):\n")
+		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-server -tokens=tokens.txt -acl=acl.txt\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo delete streams after a week, or when they use more than 1 GB:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-server -max-age=168h -max-bytes=1000000000\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo serve Prometheus metrics on http://localhost:9090/metrics:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-server -metrics-http=:9090\n\n")
+		fmt.Fprintf(os.Stderr, "\tTo stop appending to streams at 100 MB each:\n")
+		fmt.Fprintf(os.Stderr, "\t    $ httpfstream-server -stream-quota=100000000\n\n")
 		fmt.Fprintln(os.Stderr)
 		os.Exit(1)
 	}
@@ -35,8 +65,81 @@ func main() {
 	os.MkdirAll(*root, 0700)
 
 	h := httpfstream.New(*root)
-	h.Log = log.New(os.Stderr, "", 0)
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	h.Log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	h.MaxStreamBytes = *streamQuota
+	h.MaxTotalBytes = *totalQuota
+	h.MaxMessageBytes = *maxMessage
+	h.FollowerBufferSize = *followerBuffer
+	h.TailBufferSize = *tailBuffer
+	h.ResumeTimeout = *resumeTimeout
+	h.SlowFollowerTimeout = *slowFollowerTimeout
+	switch *slowFollowers {
+	case "resync":
+		h.SlowFollowers = httpfstream.ResyncSlowFollowers
+	case "disconnect":
+		h.SlowFollowers = httpfstream.DisconnectSlowFollowers
+	case "block":
+		h.SlowFollowers = httpfstream.BlockSlowFollowers
+	default:
+		log.Fatalf("invalid -slow-followers %q", *slowFollowers)
+	}
+	var auth *httpfstream.BearerAuth
+	if *tokenFile != "" {
+		f, err := os.Open(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokens, err := httpfstream.ParseTokens(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *tokenFile, err)
+		}
+		auth = &httpfstream.BearerAuth{Tokens: tokens}
+		h.Authorizer = auth
+	}
+	if *aclFile != "" {
+		rules, err := readACLRules(*aclFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acl := httpfstream.NewACL(nil, rules)
+		if auth != nil {
+			acl.Authenticator = auth
+		}
+		h.Authorizer = acl
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				rules, err := readACLRules(*aclFile)
+				if err != nil {
+					log.Printf("Not reloading access rules: %s", err)
+					continue
+				}
+				acl.SetRules(rules)
+				log.Printf("Reloaded %d access rules from %s", len(rules), *aclFile)
+			}
+		}()
+	}
+	policy := httpfstream.RetentionPolicy{MaxAge: *maxAge, MaxBytes: *maxBytes, MaxStreams: *maxStreams}
+	if policy != (httpfstream.RetentionPolicy{}) {
+		h.StartJanitor(policy, *gcInterval)
+	}
 	http.Handle("/", h)
+	if *metricsAddr != "" {
+		go func() {
+			log.Printf("Serving metrics on %s\n", *metricsAddr)
+			err := http.ListenAndServe(*metricsAddr, h.MetricsHandler())
+			if err != nil {
+				log.Fatalf("ListenAndServe: %s", err)
+			}
+		}()
+	}
 
 	log.Printf("Starting server on %s\n", *bindAddr)
 	err := http.ListenAndServe(*bindAddr, nil)
@@ -44,3 +147,16 @@ func main() {
 		log.Fatalf("ListenAndServe: %s", err)
 	}
 }
+
+func readACLRules(name string) ([]httpfstream.ACLRule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := httpfstream.ParseACLRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return rules, nil
+}
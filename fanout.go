@@ -0,0 +1,218 @@
+package httpfstream
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A SlowFollowerPolicy determines what happens when a follower doesn't receive
+// data as fast as it is appended, so that its buffer (of
+// Handler.FollowerBufferSize messages) is full. Under every policy, slow
+// followers never hold up the writer or the other followers for longer than
+// Handler.SlowFollowerTimeout per append, however many of them there are.
+type SlowFollowerPolicy int
+
+const (
+	// ResyncSlowFollowers drops the data that doesn't fit in a slow
+	// follower's buffer. When the follower catches up, it reads the data it
+	// missed from the file, so it still receives the whole stream.
+	ResyncSlowFollowers SlowFollowerPolicy = iota
+
+	// DisconnectSlowFollowers disconnects a slow follower abnormally (without
+	// ending its stream), so that it can reconnect at the offset it reached.
+	DisconnectSlowFollowers
+
+	// BlockSlowFollowers makes the writer wait for room in slow followers'
+	// buffers, for up to Handler.SlowFollowerTimeout per append in total,
+	// and then disconnects the followers that are still slow as for
+	// DisconnectSlowFollowers.
+	BlockSlowFollowers
+)
+
+// DefaultSlowFollowerTimeout is the time for which the writer waits for a slow
+// follower under BlockSlowFollowers if Handler.SlowFollowerTimeout is zero.
+const DefaultSlowFollowerTimeout = time.Second
+
+// A chunk is data that was appended to a file, which ends at offset end in the
+// file.
+type chunk struct {
+	data []byte
+	end  int64
+}
+
+// A follower receives the data appended to a file from the writer, through a
+// bounded buffer. Because each chunk of data carries its offset, a follower
+// that also reads the file can tell which data it has already sent.
+type follower struct {
+	c chan chunk
+
+	// lagged is signaled when data for the follower was dropped, so that it
+	// reads the data from the file instead.
+	lagged chan struct{}
+
+	// dropped is closed when the follower is disconnected for being slow.
+	dropped  chan struct{}
+	dropOnce sync.Once
+
+	// done is closed when the follower is removed, so that writers don't
+	// wait for it to receive data.
+	done chan struct{}
+}
+
+func (h Handler) newFollower() *follower {
+	size := h.FollowerBufferSize
+	if size <= 0 {
+		size = writeChanSize
+	}
+	return &follower{
+		c:       make(chan chunk, size),
+		lagged:  make(chan struct{}, 1),
+		dropped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// removed reports whether the follower's stream was ended by endFollowers,
+// discarding the chunks that are still buffered.
+func (fl *follower) removed() bool {
+	for {
+		select {
+		case _, ok := <-fl.c:
+			if !ok {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func (fl *follower) lag() {
+	select {
+	case fl.lagged <- struct{}{}:
+	default:
+	}
+}
+
+func (fl *follower) drop() {
+	fl.dropOnce.Do(func() { close(fl.dropped) })
+}
+
+func (fl *follower) isDropped() bool {
+	select {
+	case <-fl.dropped:
+		return true
+	default:
+		return false
+	}
+}
+
+// broadcast records data that was appended to the file at path, ending at
+// offset end, in the file's tail buffer (if any) and sends it to the file's
+// followers. It must be called after the data is written to
+// the file, so that followers that registered too late to receive it can read
+// it from the file. Followers whose buffers are full are handled according to
+// h.SlowFollowers.
+func (h Handler) broadcast(path string, data []byte, end int64) {
+	if t := h.getTail(path); t != nil {
+		t.write(data)
+	}
+
+	ch := chunk{data, end}
+
+	// Under BlockSlowFollowers, all slow followers share a single deadline,
+	// so that the writer waits for at most h.SlowFollowerTimeout per call.
+	var deadline *time.Timer
+	expired := false
+	for _, fl := range h.getFollowers(path) {
+		if fl.isDropped() {
+			continue
+		}
+		select {
+		case fl.c <- ch:
+			continue
+		default:
+		}
+
+		// The follower isn't ready to receive data.
+		atomic.AddInt64(&h.metrics.slowFollowers, 1)
+		switch h.SlowFollowers {
+		case DisconnectSlowFollowers:
+			fl.drop()
+		case BlockSlowFollowers:
+			if expired {
+				fl.drop()
+				break
+			}
+			if deadline == nil {
+				timeout := h.SlowFollowerTimeout
+				if timeout <= 0 {
+					timeout = DefaultSlowFollowerTimeout
+				}
+				deadline = time.NewTimer(timeout)
+				defer deadline.Stop()
+			}
+			select {
+			case fl.c <- ch:
+			case <-fl.done:
+			case <-deadline.C:
+				expired = true
+				fl.drop()
+			}
+		default:
+			fl.lag()
+		}
+	}
+}
+
+// copyFile sends the contents of f (the file at path) from offset to the end of
+// the file to s, and returns the offset of the end of the data it sent. Errors
+// are logged.
+//
+// If the file's tail buffer holds the data at offset, the data is sent from
+// memory instead. The file may have data after the end of the tail buffer, but
+// only if it hasn't been broadcast yet, so followers still receive it.
+func (h Handler) copyFile(path string, f File, offset int64, s followSink) (int64, error) {
+	if t := h.getTail(path); t != nil {
+		if data, end, ok := t.readFrom(offset); ok {
+			if len(data) == 0 {
+				return offset, nil
+			}
+			if err := s.write(data, end); err != nil {
+				atomic.AddInt64(&h.metrics.droppedFollowers, 1)
+				h.logWarn("Write to follower failed", "path", path, "error", err)
+				return offset, err
+			}
+			atomic.AddInt64(&h.metrics.fanoutBytes, int64(len(data)))
+			return end, nil
+		}
+	}
+
+	if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		h.logError("Failed to seek file", "path", path, "error", err)
+		return offset, err
+	}
+	buf := make([]byte, writeBufSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if werr := s.write(buf[:n], offset+int64(n)); werr != nil {
+				atomic.AddInt64(&h.metrics.droppedFollowers, 1)
+				h.logWarn("Write to follower failed", "path", path, "error", werr)
+				return offset, werr
+			}
+			offset += int64(n)
+			atomic.AddInt64(&h.metrics.fanoutBytes, int64(n))
+		}
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			h.logError("Failed to read file", "path", path, "error", err)
+			return offset, err
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package httpfstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBroadcast_slowFollower(t *testing.T) {
+	tests := []struct {
+		policy  SlowFollowerPolicy
+		dropped bool
+	}{
+		{ResyncSlowFollowers, false},
+		{DisconnectSlowFollowers, true},
+		{BlockSlowFollowers, true},
+	}
+	for _, test := range tests {
+		h := NewWithStorage(NewMemStorage())
+		h.FollowerBufferSize = 1
+		h.SlowFollowers = test.policy
+		h.SlowFollowerTimeout = 10 * time.Millisecond
+		r, _ := http.NewRequest("GET", "/file", nil)
+		fl := h.addFollower("/file", r)
+
+		start := time.Now()
+		for i := int64(1); i <= 3; i++ {
+			h.broadcast("/file", []byte("x"), i)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("policy %d: broadcast to a slow follower took %s", test.policy, d)
+		}
+		if fl.isDropped() != test.dropped {
+			t.Errorf("policy %d: want dropped == %v", test.policy, test.dropped)
+		}
+		select {
+		case <-fl.lagged:
+			if test.dropped {
+				t.Errorf("policy %d: want no lagged signal", test.policy)
+			}
+		default:
+			if !test.dropped {
+				t.Errorf("policy %d: want lagged signal", test.policy)
+			}
+		}
+		if len(fl.c) != 1 {
+			t.Errorf("policy %d: want 1 buffered chunk, got %d", test.policy, len(fl.c))
+		}
+	}
+}
+
+func TestBroadcast_blockUntilReceived(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	h.FollowerBufferSize = 1
+	h.SlowFollowers = BlockSlowFollowers
+	h.SlowFollowerTimeout = 10 * time.Second
+	r, _ := http.NewRequest("GET", "/file", nil)
+	fl := h.addFollower("/file", r)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			<-fl.c
+		}
+	}()
+	for i := int64(1); i <= 4; i++ {
+		h.broadcast("/file", []byte("x"), i)
+	}
+	if fl.isDropped() {
+		t.Error("want follower that receives data within the timeout not dropped")
+	}
+}
+
+// TestBroadcast_blockDeadline checks that slow followers share a single
+// deadline under BlockSlowFollowers, rather than each holding up the writer
+// for SlowFollowerTimeout.
+func TestBroadcast_blockDeadline(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	h.FollowerBufferSize = 1
+	h.SlowFollowers = BlockSlowFollowers
+	h.SlowFollowerTimeout = 100 * time.Millisecond
+	var fls []*follower
+	for i := 0; i < 10; i++ {
+		r, _ := http.NewRequest("GET", "/file", nil)
+		fls = append(fls, h.addFollower("/file", r))
+	}
+	h.broadcast("/file", []byte("x"), 1)
+
+	start := time.Now()
+	h.broadcast("/file", []byte("x"), 2)
+	if d := time.Since(start); d > 5*h.SlowFollowerTimeout {
+		t.Errorf("broadcast to %d slow followers took %s", len(fls), d)
+	}
+	for i, fl := range fls {
+		if !fl.isDropped() {
+			t.Errorf("follower %d: want dropped", i)
+		}
+	}
+}
+
+// TestBroadcast_blockRemovedFollower checks that the writer stops waiting for
+// a follower under BlockSlowFollowers when the follower is removed.
+func TestBroadcast_blockRemovedFollower(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	h.FollowerBufferSize = 1
+	h.SlowFollowers = BlockSlowFollowers
+	h.SlowFollowerTimeout = 10 * time.Second
+	r, _ := http.NewRequest("GET", "/file", nil)
+	fl := h.addFollower("/file", r)
+	h.broadcast("/file", []byte("x"), 1)
+
+	done := make(chan struct{})
+	go func() {
+		h.broadcast("/file", []byte("x"), 2)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.removeFollower("/file", r)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcast kept waiting for a removed follower")
+	}
+	if fl.isDropped() {
+		t.Error("want removed follower not dropped")
+	}
+}
+
+// TestFollow_resync checks that a follower skips chunks of data that it has
+// already sent and reads chunks that were dropped from the file.
+func TestFollow_resync(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	w, _ := h.Storage.Append("/file")
+	io.WriteString(w, "foo")
+	if err := h.reserveAs("/file", true); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := h.Storage.Open("/file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/file", nil)
+	fl := h.addFollower("/file", r)
+	s := new(recordingSink)
+	done := make(chan struct{})
+	go func() {
+		h.follow("/file", f, 0, fl, s)
+		close(done)
+	}()
+
+	// "foo" was also read from the file, and "bar" is dropped.
+	fl.c <- chunk{[]byte("foo"), 3}
+	io.WriteString(w, "bar")
+	fl.lag()
+	io.WriteString(w, "baz")
+	fl.c <- chunk{[]byte("baz"), 9}
+	io.WriteString(w, "qux")
+	fl.c <- chunk{[]byte("qux"), 12}
+	io.WriteString(w, "!")
+
+	// The data that is still buffered or that was never sent is read from
+	// the file when the writer finishes.
+	h.release("/file")
+	<-done
+	if want := "foobarbazqux!"; string(s.data) != want {
+		t.Errorf("want data %q, got %q", want, s.data)
+	}
+}
+
+// TestFollow_frozenFollower checks that a follower that stops reading doesn't
+// hold up the writer or the other followers.
+func TestFollow_frozenFollower(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []SlowFollowerPolicy{ResyncSlowFollowers, DisconnectSlowFollowers, BlockSlowFollowers} {
+		var h Handler
+		server := newTestServerWith(func(hh *Handler) {
+			hh.Log = nil
+			hh.FollowerBufferSize = 4
+			hh.SlowFollowers = policy
+			hh.SlowFollowerTimeout = 50 * time.Millisecond
+			h = *hh
+		})
+
+		u, _ := url.Parse(server.URL + "/file")
+		w, err := OpenAppend(u)
+		if err != nil {
+			t.Fatalf("OpenAppend: %s", err)
+		}
+		io.WriteString(w, "start")
+		waitForWrite()
+
+		frozen, _, err := DefaultClient.open(context.Background(), u, "FOLLOW", nil)
+		if err != nil {
+			t.Fatalf("FOLLOW: %s", err)
+		}
+		// Under DisconnectSlowFollowers and BlockSlowFollowers, this
+		// follower may be disconnected if it falls behind, and it resumes
+		// where it left off.
+		r := NewFollower(u, &FollowOptions{MinBackoff: 10 * time.Millisecond})
+		received := make(chan []byte)
+		go func() {
+			data, _ := ioutil.ReadAll(r)
+			received <- data
+		}()
+
+		// Write enough data to fill the frozen follower's connection and
+		// buffer.
+		msg := bytes.Repeat([]byte("0123456789abcdef"), 256)
+		want := []byte("start")
+		start := time.Now()
+		for i := 0; i < 2000; i++ {
+			if _, err := w.Write(msg); err != nil {
+				t.Fatalf("policy %d: Write: %s", policy, err)
+			}
+			want = append(want, msg...)
+		}
+		w.Close()
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("policy %d: writing took %s", policy, d)
+		}
+
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, want) {
+				t.Errorf("policy %d: follower received %d bytes, want %d", policy, len(data), len(want))
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("policy %d: follower didn't receive the end of the stream", policy)
+		}
+		if h.metrics.slowFollowers == 0 {
+			t.Errorf("policy %d: want a slow follower", policy)
+		}
+
+		r.Close()
+		frozen.Close()
+		server.close()
+	}
+}
+
+// countingSink counts the writes to a follower and the ends of its stream.
+type countingSink struct {
+	writes, closes *sync.WaitGroup
+}
+
+func (s countingSink) write(data []byte, end int64) error {
+	s.writes.Done()
+	return nil
+}
+
+func (s countingSink) keepalive() error { return nil }
+
+func (s countingSink) close(st *streamStatus) error {
+	s.closes.Done()
+	return nil
+}
+
+func (s countingSink) abort() {}
+
+// startIdleFollowers starts n followers of the empty file at path, which must
+// have an active writer. Each follower calls writes.Done for each write and
+// closes.Done when its stream ends.
+func startIdleFollowers(b *testing.B, h Handler, path string, n int, writes, closes *sync.WaitGroup) {
+	for i := 0; i < n; i++ {
+		f, err := h.Storage.Open(path, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		r, _ := http.NewRequest("GET", path, nil)
+		fl := h.addFollower(path, r)
+		closes.Add(1)
+		go func() {
+			defer h.removeFollower(path, r)
+			h.follow(path, f, 0, fl, countingSink{writes, closes})
+		}()
+	}
+}
+
+const numIdleFollowers = 10000
+
+// BenchmarkBroadcast_idleFollowers measures the time it takes to deliver
+// appended data to 10k idle followers.
+func BenchmarkBroadcast_idleFollowers(b *testing.B) {
+	h := NewWithStorage(NewMemStorage())
+	w, _ := h.Storage.Append("/file")
+	if err := h.reserveAs("/file", true); err != nil {
+		b.Fatal(err)
+	}
+	var writes, closes sync.WaitGroup
+	startIdleFollowers(b, h, "/file", numIdleFollowers, &writes, &closes)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writes.Add(numIdleFollowers)
+		io.WriteString(w, "x")
+		h.broadcast("/file", []byte("x"), int64(i+1))
+		writes.Wait()
+	}
+	b.StopTimer()
+
+	h.release("/file")
+	closes.Wait()
+}
+
+// BenchmarkWriterFinished_idleFollowers measures the time it takes for 10k
+// idle followers to end their streams when the writer finishes.
+func BenchmarkWriterFinished_idleFollowers(b *testing.B) {
+	h := NewWithStorage(NewMemStorage())
+	h.Storage.Append("/file")
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := h.reserveAs("/file", true); err != nil {
+			b.Fatal(err)
+		}
+		var writes, closes sync.WaitGroup
+		startIdleFollowers(b, h, "/file", numIdleFollowers, &writes, &closes)
+		b.StartTimer()
+
+		h.release("/file")
+		closes.Wait()
+	}
+}
@@ -0,0 +1,226 @@
+package httpfstream
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// FollowOptions configures a Follower.
+type FollowOptions struct {
+	// Offset is the byte offset in the file at which to start following.
+	Offset int64
+
+	// MinBackoff is the delay before the first reconnection attempt after a
+	// failure. The delay doubles after each consecutive failure, up to
+	// MaxBackoff. If zero, DefaultMinBackoff and DefaultMaxBackoff are used.
+	MinBackoff, MaxBackoff time.Duration
+
+	// MaxRetries is the maximum number of consecutive failed connection
+	// attempts before Read gives up and returns the last error. If zero,
+	// the Follower retries indefinitely.
+	MaxRetries int
+
+	// Client is the client used to connect to the server. If nil,
+	// DefaultClient is used.
+	Client *Client
+}
+
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// ErrFollowerClosed is returned by Read after the Follower is closed.
+var ErrFollowerClosed = errors.New("follower is closed")
+
+// A Follower follows the file at a URL, like Follow, but it survives transient
+// failures: when the connection is lost, it reconnects (with exponential
+// backoff) and resumes at the offset of the first byte it has not yet
+// returned, so that no data is duplicated or dropped.
+type Follower struct {
+	u   *url.URL
+	opt FollowOptions
+
+	rc       io.ReadCloser
+	offset   int64
+	failures int
+	closed   bool
+	closing  chan struct{}
+	mu       sync.Mutex
+}
+
+// NewFollower returns a Follower for the file at the given URL (which must be
+// handled by httpfstream's HTTP handler). It does not connect until the first
+// call to Read. If opt is nil, the default options are used.
+func NewFollower(u *url.URL, opt *FollowOptions) *Follower {
+	f := &Follower{u: u, closing: make(chan struct{})}
+	if opt != nil {
+		f.opt = *opt
+	}
+	if f.opt.MinBackoff == 0 {
+		f.opt.MinBackoff = DefaultMinBackoff
+		if f.opt.MaxBackoff == 0 {
+			f.opt.MaxBackoff = DefaultMaxBackoff
+		}
+	}
+	if f.opt.MaxBackoff < f.opt.MinBackoff {
+		f.opt.MaxBackoff = f.opt.MinBackoff
+	}
+	if f.opt.Client == nil {
+		f.opt.Client = DefaultClient
+	}
+	f.offset = f.opt.Offset
+	return f
+}
+
+// Offset returns the offset in the file of the next byte that Read will
+// return; i.e., opt.Offset plus the number of bytes read so far.
+func (f *Follower) Offset() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.offset
+}
+
+// Read implements io.Reader. It returns io.EOF when the file has been read to
+// the end and has no active writer, or an *AbortError if the writer aborted the
+// stream.
+func (f *Follower) Read(p []byte) (n int, err error) {
+	for {
+		rc, err := f.conn()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err = rc.Read(p)
+
+		f.mu.Lock()
+		f.offset += int64(n)
+		if n > 0 {
+			f.failures = 0
+		}
+		if err != nil && err != io.EOF && !isAbortError(err) {
+			// The connection failed. Discard it and reconnect (at the
+			// current offset) on the next iteration.
+			rc.Close()
+			if f.rc == rc {
+				f.rc = nil
+			}
+			if f.closed {
+				err = ErrFollowerClosed
+			} else if n == 0 {
+				err = f.backoff(err)
+				if err == nil {
+					f.mu.Unlock()
+					continue
+				}
+			} else {
+				err = nil
+			}
+		}
+		f.mu.Unlock()
+		return n, err
+	}
+}
+
+// conn returns the current connection, or opens a new one (at the current
+// offset) if there is none.
+func (f *Follower) conn() (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		if f.closed {
+			return nil, ErrFollowerClosed
+		}
+		if f.rc != nil {
+			return f.rc, nil
+		}
+
+		offset := f.offset
+		f.mu.Unlock()
+		rc, err := f.opt.Client.FollowAt(f.u, offset)
+		f.mu.Lock()
+
+		if err != nil {
+			if isPermanentFollowError(err) {
+				return nil, err
+			}
+			if err := f.backoff(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if f.closed {
+			rc.Close()
+			return nil, ErrFollowerClosed
+		}
+		f.rc = rc
+	}
+}
+
+// backoff records a failure and waits before the next connection attempt. It
+// returns err if the Follower has exhausted its retries, or ErrFollowerClosed
+// if the Follower is closed while waiting. The caller must hold f.mu, which is
+// released while waiting.
+func (f *Follower) backoff(err error) error {
+	f.failures++
+	if f.opt.MaxRetries != 0 && f.failures > f.opt.MaxRetries {
+		return err
+	}
+
+	d := backoffDelay(f.opt.MinBackoff, f.opt.MaxBackoff, f.failures)
+	f.mu.Unlock()
+	defer f.mu.Lock()
+	select {
+	case <-time.After(d):
+		return nil
+	case <-f.closing:
+		return ErrFollowerClosed
+	}
+}
+
+// backoffDelay returns the delay before the next connection attempt after the
+// given number of consecutive failures.
+func backoffDelay(min, max time.Duration, failures int) time.Duration {
+	d := min
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func isAbortError(err error) bool {
+	_, ok := err.(*AbortError)
+	return ok
+}
+
+// isPermanentFollowError reports whether err indicates that reconnecting will
+// not help.
+func isPermanentFollowError(err error) bool {
+	switch err {
+	case os.ErrNotExist, ErrOffsetOutOfRange, ErrUnauthorized, ErrForbidden:
+		return true
+	}
+	return false
+}
+
+// Close implements io.Closer. It interrupts any blocked Read.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	close(f.closing)
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package httpfstream
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dropProxy is a TCP proxy whose connections can be dropped on demand, to
+// simulate network failures.
+type dropProxy struct {
+	net.Listener
+	target string
+
+	conns []net.Conn
+	mu    sync.Mutex
+}
+
+func newDropProxy(t *testing.T, target string) *dropProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	p := &dropProxy{Listener: l, target: target}
+	go p.serve()
+	return p
+}
+
+func (p *dropProxy) serve() {
+	for {
+		c, err := p.Accept()
+		if err != nil {
+			return
+		}
+		uc, err := net.Dial("tcp", p.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, c, uc)
+		p.mu.Unlock()
+		go io.Copy(c, uc)
+		go io.Copy(uc, c)
+	}
+}
+
+// drop closes all connections that are currently open through the proxy.
+func (p *dropProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *dropProxy) close() {
+	p.Close()
+	p.drop()
+}
+
+func TestFollower(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	su, _ := url.Parse(server.URL)
+	proxy := newDropProxy(t, su.Host)
+	defer proxy.close()
+
+	u, _ := url.Parse(server.URL + "/stream")
+	pu, _ := url.Parse("http://" + proxy.Addr().String() + "/stream")
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "abc")
+	waitForWrite()
+
+	f := NewFollower(pu, &FollowOptions{MinBackoff: time.Millisecond})
+	defer f.Close()
+
+	if want, got := "abc", string(limitRead(t, f, 3)); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// Drop the connection and append more data while the Follower is
+	// reconnecting.
+	proxy.drop()
+	waitForWrite()
+	io.WriteString(w, "def")
+	waitForWrite()
+	io.WriteString(w, "ghi")
+
+	if want, got := "defghi", string(limitRead(t, f, 6)); want != got {
+		t.Errorf("after reconnect: want %q, got %q", want, got)
+	}
+	if want, got := int64(9), f.Offset(); want != got {
+		t.Errorf("want offset %d, got %d", want, got)
+	}
+
+	// Once the writer is finished, the Follower should reach EOF.
+	w.Close()
+	if rest := readAll(t, f); len(rest) != 0 {
+		t.Errorf("want no more data, got %q", rest)
+	}
+}
+
+func TestFollower_offset(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	if err := Append(u, strings.NewReader("abcdef")); err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	waitForWrite()
+
+	f := NewFollower(u, &FollowOptions{Offset: 2})
+	defer f.Close()
+	if want, got := "cdef", string(readAll(t, f)); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFollower_permanentError(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/doesntexist")
+	f := NewFollower(u, nil)
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 1)); err != os.ErrNotExist {
+		t.Errorf("want error %v, got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestFollower_maxRetries(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	u, _ := url.Parse("http://" + addr + "/foo")
+	f := NewFollower(u, &FollowOptions{MinBackoff: time.Millisecond, MaxRetries: 2})
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("want error after exhausting retries, got nil")
+	}
+}
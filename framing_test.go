@@ -0,0 +1,130 @@
+package httpfstream
+
+import (
+	"bytes"
+	"context"
+	"github.com/garyburd/go-websocket/websocket"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+)
+
+func randomBytes(rnd *rand.Rand, n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(rnd.Intn(256))
+	}
+	return p
+}
+
+func TestStream_binary(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/data.bin")
+	rnd := rand.New(rand.NewSource(1))
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+
+	var all []byte
+	first := append([]byte{0xff, 0xfe, 0x00, 0xc3}, randomBytes(rnd, 1000)...)
+	w.Write(first)
+	all = append(all, first...)
+	waitForWrite()
+
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if got := limitRead(t, r, int64(len(first))); !bytes.Equal(first, got) {
+		t.Errorf("persisted binary data differs")
+	}
+
+	for i := 0; i < 20; i++ {
+		p := randomBytes(rnd, 1+rnd.Intn(5000))
+		if i == 0 && utf8.Valid(p) {
+			t.Fatal("want invalid UTF-8 test data")
+		}
+		w.Write(p)
+		all = append(all, p...)
+		if got := limitRead(t, r, int64(len(p))); !bytes.Equal(p, got) {
+			t.Errorf("message %d: followed binary data differs", i)
+		}
+	}
+	w.Close()
+	waitForWrite()
+
+	data, err := ioutil.ReadFile(filepath.Join(server.dir, "data.bin"))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if !bytes.Equal(all, data) {
+		t.Errorf("persisted file differs (want %d bytes, got %d)", len(all), len(data))
+	}
+}
+
+// TestStream_textClients checks that clients that don't negotiate binary
+// messages still send and receive text messages.
+func TestStream_textClients(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/stream")
+
+	aws, resp, err := DefaultClient.open(context.Background(), u, "APPEND", nil)
+	if err != nil {
+		t.Fatalf("APPEND: %s", err)
+	}
+	defer aws.Close()
+	if resp.Header.Get("X-Binary") != "" {
+		t.Errorf("APPEND: want no X-Binary response header")
+	}
+	aws.WriteMessage(websocket.OpText, []byte("foo"))
+	waitForWrite()
+
+	fws, resp, err := DefaultClient.open(context.Background(), u, "FOLLOW", nil)
+	if err != nil {
+		t.Fatalf("FOLLOW: %s", err)
+	}
+	defer fws.Close()
+	if resp.Header.Get("X-Binary") != "" {
+		t.Errorf("FOLLOW: want no X-Binary response header")
+	}
+
+	for _, want := range []string{"foo", "bar"} {
+		if want == "bar" {
+			aws.WriteMessage(websocket.OpText, []byte(want))
+		}
+		op, rdr, err := fws.NextReader()
+		if err != nil {
+			t.Fatalf("NextReader: %s", err)
+		}
+		if op != websocket.OpText {
+			t.Errorf("want text message, got op %d", op)
+		}
+		if got := string(readAll(t, rdr)); want != got {
+			t.Errorf("want msg == %q, got %q", want, got)
+		}
+	}
+
+	// The negotiated clients use binary messages.
+	bws, resp, err := DefaultClient.open(context.Background(), u, "FOLLOW", http.Header{"X-Binary": []string{"1"}})
+	if err != nil {
+		t.Fatalf("FOLLOW: %s", err)
+	}
+	defer bws.Close()
+	if resp.Header.Get("X-Binary") != "1" {
+		t.Errorf("FOLLOW: want X-Binary response header")
+	}
+}
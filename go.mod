@@ -0,0 +1,3 @@
+module github.com/sourcegraph/httpfstream
+
+go 1.21
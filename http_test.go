@@ -17,6 +17,12 @@ type testServer struct {
 }
 
 func newTestServer() testServer {
+	return newTestServerWith(nil)
+}
+
+// newTestServerWith returns a test server whose Handler is modified by
+// configure (if non-nil) before it starts.
+func newTestServerWith(configure func(h *Handler)) testServer {
 	dir, err := ioutil.TempDir("", "httpfstream")
 	if err != nil {
 		panic("TempDir: " + err.Error())
@@ -28,7 +34,10 @@ func newTestServer() testServer {
 
 	rootMux := http.NewServeMux()
 	h := New(dir)
-	h.Log = log.New(os.Stderr, "", 0)
+	h.Log = NewLogger(log.New(os.Stderr, "", 0), true)
+	if configure != nil {
+		configure(&h)
+	}
 	rootMux.Handle("/", h)
 	return testServer{
 		Server: httptest.NewServer(rootMux),
@@ -50,6 +59,19 @@ func httpGET(t *testing.T, u *url.URL) string {
 	return string(readAll(t, resp.Body))
 }
 
+// httpGETSnapshot is like httpGET, but it requests a snapshot of a file that
+// may have an active writer (instead of following it until the writer finishes).
+func httpGETSnapshot(t *testing.T, u *url.URL) string {
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	req.Header.Set("Range", "bytes=0-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("httpGETSnapshot %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+	return string(readAll(t, resp.Body))
+}
+
 func readAll(t *testing.T, rdr io.Reader) []byte {
 	data, err := ioutil.ReadAll(rdr)
 	if err != nil {
@@ -0,0 +1,112 @@
+package httpfstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"time"
+)
+
+// StreamInfo describes a stream (a file in storage).
+type StreamInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+
+	// Writing is whether the stream has an active writer.
+	Writing bool `json:"writing"`
+
+	// Followers is the number of clients that are following the stream live.
+	Followers int `json:"followers"`
+}
+
+// Streams returns information about the stream at path or, if path is a
+// directory, about all of the streams under it (recursively), sorted by path.
+func (h Handler) Streams(path string) ([]StreamInfo, error) {
+	path = h.resolve(path)
+	if isStatusPath(path) {
+		return nil, os.ErrNotExist
+	}
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []StreamInfo{h.streamInfo(path, fi.Size(), fi.ModTime())}, nil
+	}
+
+	streams := []StreamInfo{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		fis, err := h.storage().List(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if isStatusPath(fi.Name()) {
+				continue
+			}
+			p := pathpkg.Join(dir, fi.Name())
+			if fi.IsDir() {
+				if err := walk(p); err != nil {
+					return err
+				}
+				continue
+			}
+			streams = append(streams, h.streamInfo(p, fi.Size(), fi.ModTime()))
+		}
+		return nil
+	}
+	if err := walk(path); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+func (h Handler) streamInfo(path string, size int64, modTime time.Time) StreamInfo {
+	h.followersMu.Lock()
+	followers := len(h.followers[path])
+	h.followersMu.Unlock()
+	return StreamInfo{
+		Path:      path,
+		Size:      size,
+		ModTime:   modTime,
+		Writing:   h.isWriting(path),
+		Followers: followers,
+	}
+}
+
+// List handles LIST requests, which return a JSON array of the streams (as
+// StreamInfo objects) at or under the requested path. If h.Authorizer is set,
+// the request must be allowed to FOLLOW the requested path, and streams that
+// it may not FOLLOW are omitted.
+func (h Handler) List(w http.ResponseWriter, r *http.Request) {
+	path := h.resolve(r.URL.Path)
+	h.logDebug("Request started", "verb", "LIST", "path", path, "remote_addr", r.RemoteAddr)
+
+	if !h.authorize(w, r, "FOLLOW", path) {
+		return
+	}
+
+	streams, err := h.Streams(path)
+	if err != nil {
+		h.storageError(w, err)
+		return
+	}
+	if h.Authorizer != nil {
+		allowed := streams[:0]
+		for _, s := range streams {
+			if h.Authorizer.Authorize(r, "FOLLOW", s.Path) == nil {
+				allowed = append(allowed, s)
+			}
+		}
+		streams = allowed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(streams); err != nil {
+		h.logWarn("Failed to write listing", "path", path, "error", err)
+	}
+}
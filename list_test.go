@@ -0,0 +1,134 @@
+package httpfstream
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func getStreams(t *testing.T, u *url.URL) []StreamInfo {
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	req.Header.Set(xVerb, "LIST")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("LIST %s: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("LIST %s: HTTP status %d", u, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("LIST %s: want Content-Type application/json, got %q", u, ct)
+	}
+	var streams []StreamInfo
+	if err := json.NewDecoder(resp.Body).Decode(&streams); err != nil {
+		t.Fatalf("LIST %s: %s", u, err)
+	}
+	return streams
+}
+
+func TestList(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	os.MkdirAll(filepath.Join(server.dir, "builds", "1"), 0700)
+	if err := ioutil.WriteFile(filepath.Join(server.dir, "builds", "1", "log"), []byte("done"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(server.URL + "/builds/2")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "foo")
+	waitForWrite()
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	limitRead(t, r, 3)
+
+	root, _ := url.Parse(server.URL + "/builds")
+	streams := getStreams(t, root)
+	if len(streams) != 2 {
+		t.Fatalf("want 2 streams, got %+v", streams)
+	}
+	want := []StreamInfo{
+		{Path: "/builds/1/log", Size: 4},
+		{Path: "/builds/2", Size: 3, Writing: true, Followers: 1},
+	}
+	for i, s := range streams {
+		if s.ModTime.IsZero() {
+			t.Errorf("%s: want modification time", s.Path)
+		}
+		s.ModTime = want[i].ModTime
+		if s != want[i] {
+			t.Errorf("want stream %+v, got %+v", want[i], s)
+		}
+	}
+
+	// Listing a single stream.
+	streams = getStreams(t, u)
+	if len(streams) != 1 || streams[0].Path != "/builds/2" || !streams[0].Writing {
+		t.Errorf("want live stream /builds/2, got %+v", streams)
+	}
+
+	w.Close()
+	checkEndOfStream(t, "follower", r, nil)
+	r.Close()
+	waitForWrite()
+	streams = getStreams(t, u)
+	if len(streams) != 1 || streams[0].Writing || streams[0].Followers != 0 {
+		t.Errorf("want finished stream without followers, got %+v", streams)
+	}
+
+	// Status files aren't streams.
+	for _, p := range []string{"/builds/2" + statusSuffix, "/builds/2" + statusSuffix + "/x"} {
+		su, _ := url.Parse(server.URL + p)
+		for _, verb := range []string{"LIST", "WATCH", "FOLLOW"} {
+			req, _ := http.NewRequest("GET", su.String(), nil)
+			req.Header.Set(xVerb, verb)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %s", verb, p, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("%s %s: want HTTP 404, got %d", verb, p, resp.StatusCode)
+			}
+		}
+	}
+}
+
+func TestList_authorizer(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) {
+		h.Authorizer = NewACL(nil, []ACLRule{
+			{Allow: false, Path: "/secrets/**", Verb: "*", Principal: "*"},
+			{Allow: true, Path: "/**", Verb: "FOLLOW", Principal: "*"},
+		})
+	})
+	defer server.close()
+
+	os.MkdirAll(filepath.Join(server.dir, "secrets"), 0700)
+	for _, name := range []string{"public", "secrets/key"} {
+		if err := ioutil.WriteFile(filepath.Join(server.dir, name), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, _ := url.Parse(server.URL + "/")
+	streams := getStreams(t, u)
+	if len(streams) != 1 || streams[0].Path != "/public" {
+		t.Errorf("want only /public, got %+v", streams)
+	}
+}
@@ -0,0 +1,196 @@
+package httpfstream
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Logger records leveled, structured log records. Each record has a message
+// and a list of alternating keys and values, such as "path", "/foo", "bytes",
+// 42. A *slog.Logger (from log/slog) is a Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// NewLogger returns a Logger that writes each record to l, as a line of the
+// form "LEVEL msg key=value ...". Debug records are discarded unless debug is
+// true.
+func NewLogger(l *log.Logger, debug bool) Logger {
+	return &stdLogger{l, debug}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (l *stdLogger) Debug(msg string, args ...interface{}) {
+	if l.debug {
+		l.output("DEBUG", msg, args)
+	}
+}
+
+func (l *stdLogger) Info(msg string, args ...interface{})  { l.output("INFO", msg, args) }
+func (l *stdLogger) Warn(msg string, args ...interface{})  { l.output("WARN", msg, args) }
+func (l *stdLogger) Error(msg string, args ...interface{}) { l.output("ERROR", msg, args) }
+
+func (l *stdLogger) output(level, msg string, args []interface{}) {
+	var buf bytes.Buffer
+	buf.WriteString(level)
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		key, val := "!BADKEY", args[i]
+		if i+1 < len(args) {
+			key, val = fmt.Sprint(args[i]), args[i+1]
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(formatLogValue(val))
+	}
+	l.l.Output(3, buf.String())
+}
+
+// formatLogValue formats a value in a log record, quoting it if necessary so
+// that the record can be split into fields.
+func formatLogValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '=' || r == '"' }) != -1 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (h Handler) logDebug(msg string, args ...interface{}) {
+	if h.Log != nil {
+		h.Log.Debug(msg, args...)
+	}
+}
+
+func (h Handler) logInfo(msg string, args ...interface{}) {
+	if h.Log != nil {
+		h.Log.Info(msg, args...)
+	}
+}
+
+func (h Handler) logWarn(msg string, args ...interface{}) {
+	if h.Log != nil {
+		h.Log.Warn(msg, args...)
+	}
+}
+
+func (h Handler) logError(msg string, args ...interface{}) {
+	if h.Log != nil {
+		h.Log.Error(msg, args...)
+	}
+}
+
+// A session records the outcome of an APPEND or FOLLOW request, which is
+// logged in a single access log record when the request ends. It wraps the
+// request's http.ResponseWriter to record the response status.
+type session struct {
+	http.ResponseWriter
+	r          *http.Request
+	verb, path string
+	start      time.Time
+
+	status  int   // HTTP status of the response (101 for WebSockets)
+	written int64 // bytes written to the response body
+	bytes   int64 // bytes of file data appended or followed
+	result  *streamStatus
+}
+
+// startSession starts recording a request. The caller must respond to the
+// request through the returned session's writer and then call h.endSession.
+func (h Handler) startSession(w http.ResponseWriter, r *http.Request, verb, path string) *session {
+	h.logDebug("Request started", "verb", verb, "path", path, "remote_addr", r.RemoteAddr)
+	return &session{ResponseWriter: w, r: r, verb: verb, path: path, start: time.Now()}
+}
+
+// endSession writes the access log record of s.
+func (h Handler) endSession(s *session) {
+	status := s.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	args := []interface{}{
+		"verb", s.verb,
+		"path", s.path,
+		"remote_addr", s.r.RemoteAddr,
+		"status", status,
+		"bytes", s.bytes,
+		"duration", time.Since(s.start),
+	}
+	if s.result != nil && s.result.Aborted {
+		args = append(args, "aborted", true, "reason", s.result.Reason)
+	}
+	h.logInfo("Access", args...)
+}
+
+func (s *session) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *session) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// writer returns s as an http.ResponseWriter that implements http.Flusher if
+// (and only if) the underlying ResponseWriter does, so that handlers can tell
+// whether they can stream the response.
+func (s *session) writer() http.ResponseWriter {
+	if _, ok := s.ResponseWriter.(http.Flusher); ok {
+		return flushingSession{s}
+	}
+	return s
+}
+
+// A flushingSession is a session whose underlying ResponseWriter implements
+// http.Flusher.
+type flushingSession struct {
+	*session
+}
+
+// Flush implements http.Flusher.
+func (s flushingSession) Flush() {
+	s.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack implements http.Hijacker (for WebSockets), if the underlying
+// ResponseWriter does.
+func (s *session) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (s *session) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,147 @@
+package httpfstream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(log.New(&buf, "", 0), false)
+	l.Debug("hidden")
+	l.Info("Access", "path", "/a b", "bytes", 3, "reason", "", "odd")
+	l.Error("Failed", "error", io.EOF)
+
+	want := "INFO Access path=\"/a b\" bytes=3 reason=\"\" !BADKEY=odd\nERROR Failed error=EOF\n"
+	if got := buf.String(); got != want {
+		t.Errorf("want log\n%s\ngot\n%s", want, got)
+	}
+}
+
+// logRecord is a record logged to a recordingLogger.
+type logRecord struct {
+	level, msg string
+	attrs      map[string]interface{}
+}
+
+// recordingLogger is a Logger that records the records logged to it.
+type recordingLogger struct {
+	records []logRecord
+	mu      sync.Mutex
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := logRecord{level, msg, make(map[string]interface{})}
+	for i := 0; i+1 < len(args); i += 2 {
+		r.attrs[fmt.Sprint(args[i])] = args[i+1]
+	}
+	l.records = append(l.records, r)
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("ERROR", msg, args) }
+
+// accessRecords returns the access log records for verb.
+func (l *recordingLogger) accessRecords(verb string) []logRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var rs []logRecord
+	for _, r := range l.records {
+		if r.msg == "Access" && r.attrs["verb"] == verb {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+	logger := new(recordingLogger)
+	server := newTestServerWith(func(h *Handler) { h.Log = logger })
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/foo")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "foo")
+	waitForWrite()
+	if _, err := OpenAppend(u); err != ErrWriterConflict {
+		t.Fatalf("OpenAppend: want error %v, got %v", ErrWriterConflict, err)
+	}
+	w.Abort("oops")
+	waitForWrite()
+
+	if data := httpGET(t, u); data != "foo" {
+		t.Errorf("want data %q, got %q", "foo", data)
+	}
+	waitForWrite()
+
+	check := func(r logRecord, status int, bytes int64) {
+		if r.level != "INFO" || r.attrs["path"] != "/foo" || r.attrs["status"] != status || r.attrs["bytes"] != bytes {
+			t.Errorf("want INFO record for /foo with status %d and %d bytes, got %+v", status, bytes, r)
+		}
+		if r.attrs["remote_addr"] == "" {
+			t.Errorf("want remote_addr, got %+v", r)
+		}
+		if _, ok := r.attrs["duration"].(time.Duration); !ok {
+			t.Errorf("want duration, got %+v", r)
+		}
+	}
+	appends := logger.accessRecords("APPEND")
+	if len(appends) != 2 {
+		t.Fatalf("want 2 APPEND access records, got %+v", appends)
+	}
+	// The conflicting APPEND ended first.
+	check(appends[0], 409, 0)
+	check(appends[1], 101, 3)
+	if appends[1].attrs["aborted"] != true || appends[1].attrs["reason"] != "oops" {
+		t.Errorf("want aborted APPEND with reason %q, got %+v", "oops", appends[1])
+	}
+
+	follows := logger.accessRecords("FOLLOW")
+	if len(follows) != 1 {
+		t.Fatalf("want 1 FOLLOW access record, got %+v", follows)
+	}
+	check(follows[0], 200, 3)
+}
+
+// plainResponseWriter is an http.ResponseWriter that doesn't implement
+// http.Flusher.
+type plainResponseWriter struct {
+	http.ResponseWriter
+}
+
+func TestSession_flusher(t *testing.T) {
+	var h Handler
+	r, _ := http.NewRequest("GET", "/foo", nil)
+
+	s := h.startSession(plainResponseWriter{httptest.NewRecorder()}, r, "FOLLOW", "/foo")
+	if _, ok := s.writer().(http.Flusher); ok {
+		t.Error("want session of a ResponseWriter without Flush not to implement http.Flusher")
+	}
+
+	rec := httptest.NewRecorder()
+	s = h.startSession(rec, r, "FOLLOW", "/foo")
+	f, ok := s.writer().(http.Flusher)
+	if !ok {
+		t.Fatal("want session of a ResponseWriter with Flush to implement http.Flusher")
+	}
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("want Flush to flush the underlying ResponseWriter")
+	}
+}
@@ -0,0 +1,113 @@
+package httpfstream
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metrics holds the counters that a Handler exports (see
+// Handler.MetricsHandler). They are updated atomically.
+type metrics struct {
+	appendedBytes    int64
+	fanoutBytes      int64
+	slowFollowers    int64
+	droppedFollowers int64
+	httpFallbacks    int64
+
+	disconnectedSlowFollowers int64
+
+	appendUpgradeFailures int64
+	followUpgradeFailures int64
+}
+
+// MetricsHandler returns an http.Handler that reports statistics about h in
+// the Prometheus text exposition format:
+//
+//	httpfstream_writers                                 streams with an active APPEND
+//	httpfstream_followers{path}                         active followers of each stream
+//	httpfstream_appended_bytes_total                    bytes appended to streams
+//	httpfstream_fanout_bytes_total                      bytes sent to followers
+//	httpfstream_slow_followers_total                    times a follower fell behind
+//	httpfstream_dropped_followers_total                 followers dropped because sending failed
+//	httpfstream_disconnected_slow_followers_total       slow followers disconnected
+//	httpfstream_websocket_upgrade_failures_total{verb}  failed WebSocket handshakes
+//	httpfstream_http_fallbacks_total                    FOLLOWs streamed over plain HTTP
+//
+// It is meant to be served separately from h (e.g., on another port), since
+// any path that h handles may be a file.
+func (h Handler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.writeMetrics(w)
+	})
+}
+
+func (h Handler) writeMetrics(w io.Writer) {
+	h.writersMu.Lock()
+	writers := 0
+	for _, aw := range h.writers {
+		if aw.appending {
+			writers++
+		}
+	}
+	h.writersMu.Unlock()
+
+	h.followersMu.Lock()
+	followers := make(map[string]int, len(h.followers))
+	paths := make([]string, 0, len(h.followers))
+	for path, fs := range h.followers {
+		followers[path] = len(fs)
+		paths = append(paths, path)
+	}
+	h.followersMu.Unlock()
+	sort.Strings(paths)
+
+	m := h.metrics
+	load := atomic.LoadInt64
+
+	writeMetric(w, "httpfstream_writers", "gauge", "Number of streams with an active APPEND session.")
+	fmt.Fprintf(w, "httpfstream_writers %d\n", writers)
+
+	writeMetric(w, "httpfstream_followers", "gauge", "Number of active followers of each stream.")
+	for _, path := range paths {
+		fmt.Fprintf(w, "httpfstream_followers{path=\"%s\"} %d\n", escapeLabel(path), followers[path])
+	}
+
+	writeMetric(w, "httpfstream_appended_bytes_total", "counter", "Bytes appended to streams.")
+	fmt.Fprintf(w, "httpfstream_appended_bytes_total %d\n", load(&m.appendedBytes))
+
+	writeMetric(w, "httpfstream_fanout_bytes_total", "counter", "Bytes sent to followers.")
+	fmt.Fprintf(w, "httpfstream_fanout_bytes_total %d\n", load(&m.fanoutBytes))
+
+	writeMetric(w, "httpfstream_slow_followers_total", "counter", "Times a follower fell behind, i.e., its buffer was full when data was appended.")
+	fmt.Fprintf(w, "httpfstream_slow_followers_total %d\n", load(&m.slowFollowers))
+
+	writeMetric(w, "httpfstream_dropped_followers_total", "counter", "Followers disconnected because sending data to them failed.")
+	fmt.Fprintf(w, "httpfstream_dropped_followers_total %d\n", load(&m.droppedFollowers))
+
+	writeMetric(w, "httpfstream_disconnected_slow_followers_total", "counter", "Slow followers disconnected under the disconnect or block policy.")
+	fmt.Fprintf(w, "httpfstream_disconnected_slow_followers_total %d\n", load(&m.disconnectedSlowFollowers))
+
+	writeMetric(w, "httpfstream_websocket_upgrade_failures_total", "counter", "WebSocket handshakes that failed, by verb.")
+	fmt.Fprintf(w, "httpfstream_websocket_upgrade_failures_total{verb=\"APPEND\"} %d\n", load(&m.appendUpgradeFailures))
+	fmt.Fprintf(w, "httpfstream_websocket_upgrade_failures_total{verb=\"FOLLOW\"} %d\n", load(&m.followUpgradeFailures))
+
+	writeMetric(w, "httpfstream_http_fallbacks_total", "counter", "FOLLOW requests for active streams that were streamed over plain HTTP instead of a WebSocket.")
+	fmt.Fprintf(w, "httpfstream_http_fallbacks_total %d\n", load(&m.httpFallbacks))
+}
+
+// writeMetric writes the HELP and TYPE lines for a metric.
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value for the Prometheus text format.
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
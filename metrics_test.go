@@ -0,0 +1,83 @@
+package httpfstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	t.Parallel()
+	var h Handler
+	server := newTestServerWith(func(hh *Handler) { h = *hh })
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/foo")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "hello")
+	waitForWrite()
+
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	limitRead(t, r, 5)
+
+	// A FOLLOW that isn't a WebSocket falls back to plain HTTP.
+	resp, err := http.Get(u.String())
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+	limitRead(t, resp.Body, 5)
+
+	// An APPEND must be a WebSocket.
+	resp2, err := http.Get(server.URL + "/bar?verb=APPEND")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp2.Body.Close()
+	waitForWrite()
+
+	// Reservations (e.g., for a DELETE) aren't writers.
+	if err := h.reserve("/baz"); err != nil {
+		t.Fatal(err)
+	}
+	defer h.release("/baz")
+
+	rec := httptest.NewRecorder()
+	h.MetricsHandler().ServeHTTP(rec, nil)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("want text/plain Content-Type, got %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE httpfstream_writers gauge\n",
+		"\nhttpfstream_writers 1\n",
+		"\nhttpfstream_followers{path=\"/foo\"} 2\n",
+		"\nhttpfstream_appended_bytes_total 5\n",
+		"\nhttpfstream_fanout_bytes_total 10\n",
+		"\nhttpfstream_disconnected_slow_followers_total 0\n",
+		"\nhttpfstream_websocket_upgrade_failures_total{verb=\"APPEND\"} 1\n",
+		"\nhttpfstream_websocket_upgrade_failures_total{verb=\"FOLLOW\"} 0\n",
+		"\nhttpfstream_http_fallbacks_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if want, got := `/a\\b\"c\nd`, escapeLabel("/a\\b\"c\nd"); want != got {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
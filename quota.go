@@ -0,0 +1,124 @@
+package httpfstream
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQuotaExceeded indicates that the server refused data because the file (or
+// the server's storage as a whole) reached its size limit.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// A QuotaError is returned to an appender after the server refused its data
+// because it exceeded a limit. Reason is the reason that the server sent in
+// its end-of-stream marker, which is also the reason with which the stream was
+// aborted.
+type QuotaError struct {
+	Reason string
+}
+
+func (e *QuotaError) Error() string {
+	return ErrQuotaExceeded.Error() + ": " + e.Reason
+}
+
+// Is reports whether target is ErrQuotaExceeded, so that errors.Is(err,
+// ErrQuotaExceeded) holds for a *QuotaError.
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+const (
+	// xMaxSize and xMaxMessageSize are sent in the WebSocket handshake
+	// response to APPEND requests if the server limits the size of the file
+	// or of each message, respectively, so that clients can stay within the
+	// limits.
+	xMaxSize        = "X-Max-Size"
+	xMaxMessageSize = "X-Max-Message-Size"
+)
+
+// The reasons with which an APPEND is aborted when it exceeds a limit.
+const (
+	reasonMessageTooLarge = "message too large"
+	reasonStreamLimit     = "stream size limit exceeded"
+	reasonTotalLimit      = "storage quota exceeded"
+)
+
+// diskUsage tracks the total size of all files, for enforcing
+// Handler.MaxTotalBytes. It is computed from h.Storage when it is first needed
+// and kept up to date as files are appended to and removed.
+type diskUsage struct {
+	bytes int64
+	known bool
+	mu    sync.Mutex
+}
+
+// addUsage records that the total size of all files changed by n bytes.
+func (h Handler) addUsage(n int64) {
+	h.usage.mu.Lock()
+	defer h.usage.mu.Unlock()
+	if h.usage.known {
+		h.usage.bytes += n
+	}
+}
+
+// quotaFull reports whether a file of the given size can't grow at all, and if
+// so, why.
+func (h Handler) quotaFull(size int64) (string, bool) {
+	if h.MaxStreamBytes > 0 && size >= h.MaxStreamBytes {
+		return reasonStreamLimit, true
+	}
+	if h.MaxTotalBytes > 0 {
+		h.usage.mu.Lock()
+		defer h.usage.mu.Unlock()
+		h.loadUsage()
+		if h.usage.bytes >= h.MaxTotalBytes {
+			return reasonTotalLimit, true
+		}
+	}
+	return "", false
+}
+
+// allot returns how many of n bytes may be appended to a file of the given
+// size and, if that is fewer than n, the reason. The bytes it allots count
+// toward MaxTotalBytes; if they can't be written, the caller must give them
+// back with h.addUsage.
+func (h Handler) allot(size, n int64) (int64, string) {
+	var reason string
+	if h.MaxStreamBytes > 0 && size+n > h.MaxStreamBytes {
+		n, reason = h.MaxStreamBytes-size, reasonStreamLimit
+		if n < 0 {
+			n = 0
+		}
+	}
+	if h.MaxTotalBytes > 0 {
+		h.usage.mu.Lock()
+		defer h.usage.mu.Unlock()
+		h.loadUsage()
+		if avail := h.MaxTotalBytes - h.usage.bytes; n > avail {
+			n, reason = avail, reasonTotalLimit
+			if n < 0 {
+				n = 0
+			}
+		}
+		h.usage.bytes += n
+	}
+	return n, reason
+}
+
+// loadUsage computes the total size of all files, if it isn't known yet. The
+// caller must hold h.usage.mu.
+func (h Handler) loadUsage() {
+	if h.usage.known {
+		return
+	}
+	streams, err := h.Streams("/")
+	if err != nil {
+		h.logError("Failed to compute storage usage", "error", err)
+		return
+	}
+	h.usage.bytes = 0
+	for _, s := range streams {
+		h.usage.bytes += s.Size
+	}
+	h.usage.known = true
+}
@@ -0,0 +1,208 @@
+package httpfstream
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/go-websocket/websocket"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// appendRaw sends each of msgs in its own WebSocket message to the file at u,
+// without splitting or checking them against the server's limits.
+func appendRaw(t *testing.T, u *url.URL, msgs ...string) {
+	ws, _, err := DefaultClient.open(context.Background(), u, "APPEND", nil)
+	if err != nil {
+		t.Fatalf("APPEND: %s", err)
+	}
+	for _, msg := range msgs {
+		ws.WriteMessage(websocket.OpBinary, []byte(msg))
+	}
+	waitForWrite()
+	ws.Close()
+	waitForWrite()
+}
+
+// checkStream checks that the file at u contains data and that its stream
+// ended with the error want.
+func checkStream(t *testing.T, label string, u *url.URL, data string, want error) {
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("%s: Follow: %s", label, err)
+	}
+	defer r.Close()
+	if got := string(limitRead(t, r, int64(len(data)))); got != data {
+		t.Errorf("%s: want data %q, got %q", label, data, got)
+	}
+	checkEndOfStream(t, label, r, want)
+}
+
+func TestAppend_maxMessageBytes(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) { h.MaxMessageBytes = 4 })
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/raw")
+	appendRaw(t, u, "foo", "toolong", "bar")
+	checkStream(t, "raw", u, "foo", &AbortError{Reason: reasonMessageTooLarge})
+
+	// Clients split writes into messages that the server accepts.
+	u, _ = url.Parse(server.URL + "/split")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	if _, err := io.WriteString(w, "0123456789"); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	w.Close()
+
+	a := NewAppender(u, nil)
+	io.WriteString(a, "abcdefgh")
+	if err := a.Close(); err != nil {
+		t.Fatalf("Appender.Close: %s", err)
+	}
+	waitForWrite()
+	checkStream(t, "split", u, "0123456789abcdefgh", nil)
+}
+
+func TestAppend_maxStreamBytes(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) { h.MaxStreamBytes = 10 })
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/raw")
+	appendRaw(t, u, "foo", "12345678", "bar")
+	checkStream(t, "raw", u, "foo", &AbortError{Reason: reasonStreamLimit})
+
+	u, _ = url.Parse(server.URL + "/client")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "12345")
+	if _, err := io.WriteString(w, "123456"); err != ErrQuotaExceeded {
+		t.Errorf("Write over limit: want error %v, got %v", ErrQuotaExceeded, err)
+	}
+	w.Close()
+
+	a := NewAppender(u, nil)
+	if _, err := io.WriteString(a, "123456"); err != ErrQuotaExceeded {
+		t.Errorf("Appender.Write over limit: want error %v, got %v", ErrQuotaExceeded, err)
+	}
+	io.WriteString(a, "abcde")
+	if err := a.Close(); err != nil {
+		t.Fatalf("Appender.Close: %s", err)
+	}
+	waitForWrite()
+	checkStream(t, "client", u, "12345abcde", nil)
+
+	// A full file can't be appended to.
+	if _, err := OpenAppend(u); err != ErrQuotaExceeded {
+		t.Errorf("OpenAppend full file: want error %v, got %v", ErrQuotaExceeded, err)
+	}
+
+	// A POST body is refused up front if its length is known, or else
+	// appended until the file is full.
+	u, _ = url.Parse(server.URL + "/http")
+	resp, err := http.Post(u.String(), "text/plain", strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	resp.Body.Close()
+	resp, err = http.Post(u.String(), "text/plain", strings.NewReader("12345678"))
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST with Content-Length: want HTTP status %d, got %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+	resp, err = http.Post(u.String(), "text/plain", io.MultiReader(strings.NewReader("12345678")))
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || resp.Header.Get(xOffset) != "10" {
+		t.Errorf("chunked POST: want HTTP status %d and offset 10, got %d and %q", http.StatusRequestEntityTooLarge, resp.StatusCode, resp.Header.Get(xOffset))
+	}
+	checkStream(t, "http", u, "foo1234567", &AbortError{Reason: reasonStreamLimit})
+}
+
+func TestAppend_maxTotalBytes(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) { h.MaxTotalBytes = 10 })
+	defer server.close()
+
+	a, _ := url.Parse(server.URL + "/a")
+	b, _ := url.Parse(server.URL + "/b")
+	appendRaw(t, a, "123456")
+	appendRaw(t, b, "foo", "12345", "bar")
+	checkStream(t, "b", b, "foo", &AbortError{Reason: reasonTotalLimit})
+
+	appendRaw(t, b, "x")
+	if _, err := OpenAppend(b); err != ErrQuotaExceeded {
+		t.Errorf("OpenAppend when storage is full: want error %v, got %v", ErrQuotaExceeded, err)
+	}
+
+	// Deleting a file frees space.
+	if err := Delete(a); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	appendRaw(t, b, "12345")
+	checkStream(t, "b after delete", b, "foox12345", nil)
+
+	// An Appender retries data that doesn't fit (in case space is freed),
+	// but not indefinitely.
+	c, _ := url.Parse(server.URL + "/c")
+	ap := NewAppender(c, &AppendOptions{MinBackoff: time.Millisecond, MaxRetries: 2})
+	io.WriteString(ap, "12")
+	if err := ap.Close(); err != errNoProgress {
+		t.Errorf("Appender.Close when storage is full: want error %v, got %v", errNoProgress, err)
+	}
+}
+
+func TestOpenAppend_refused(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) { h.MaxTotalBytes = 10 })
+	defer server.close()
+
+	// The client doesn't know how much space is left in the server's
+	// storage, so the server refuses the data that doesn't fit.
+	u, _ := url.Parse(server.URL + "/file")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	if _, err := io.WriteString(w, "12345678901"); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	<-w.(*appendWriteCloser).readDone
+
+	want := &QuotaError{Reason: reasonTotalLimit}
+	if _, err := io.WriteString(w, "x"); !reflect.DeepEqual(err, want) {
+		t.Errorf("Write after refusal: want error %v, got %v", want, err)
+	}
+	if err := w.Close(); !reflect.DeepEqual(err, want) {
+		t.Errorf("Close after refusal: want error %v, got %v", want, err)
+	}
+	if !errors.Is(want, ErrQuotaExceeded) {
+		t.Errorf("want %v to match %v", want, ErrQuotaExceeded)
+	}
+	checkStream(t, "file", u, "", &AbortError{Reason: reasonTotalLimit})
+
+	// Close reports a refusal of the last data, too.
+	w, err = OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "12345678901")
+	if err := w.Close(); !reflect.DeepEqual(err, want) {
+		t.Errorf("Close: want error %v, got %v", want, err)
+	}
+}
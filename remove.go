@@ -0,0 +1,164 @@
+package httpfstream
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// archiveSuffix, followed by a number, is appended to a file's path to name
+// its archives (see Rotate). Clients can't APPEND to paths that contain it, so
+// archives never collide with the streams that clients write.
+const archiveSuffix = ".httpfstream-archive."
+
+// isArchivePath reports whether path is reserved for archives, or is under such
+// a path.
+func isArchivePath(path string) bool {
+	return strings.Contains(path, archiveSuffix)
+}
+
+// removedStatus is the status with which the streams of followers end when the
+// file they are following is deleted or rotated.
+var removedStatus = streamStatus{Aborted: true, Reason: "stream removed"}
+
+// endFollowers ends the streams of path's followers (with removedStatus), by
+// closing their channels, when the file is removed. The caller must have
+// reserved path.
+func (h Handler) endFollowers(path string) {
+	h.writersMu.Lock()
+	if aw := h.writers[path]; aw != nil {
+		aw.removed = true
+	}
+	h.writersMu.Unlock()
+
+	h.followersMu.Lock()
+	defer h.followersMu.Unlock()
+	for _, fl := range h.followers[path] {
+		close(fl.c)
+	}
+	delete(h.followers, path)
+}
+
+// removeRequest performs the checks common to DELETE and ROTATE requests for
+// path. It reserves path (so that no writer can start while it is being
+// removed) and returns true if the request may proceed, in which case the
+// caller must call h.release(path). Otherwise, it writes an error response.
+func (h Handler) removeRequest(w http.ResponseWriter, r *http.Request, verb, path string) bool {
+	if !h.authorize(w, r, verb, path) {
+		return false
+	}
+	if isStatusPath(path) || (verb == "ROTATE" && isArchivePath(path)) {
+		http.Error(w, "path is reserved", http.StatusForbidden)
+		return false
+	}
+
+	if err := h.reserve(path); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		h.release(path)
+		h.storageError(w, err)
+		return false
+	}
+	if fi.IsDir() {
+		h.release(path)
+		http.Error(w, "path is a directory", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Delete handles DELETE requests, which delete a file and its status. If the
+// file has an active writer, the server responds with HTTP 409. Clients that
+// are still following the file receive the end of the stream, with the status
+// "aborted" and the reason "stream removed".
+func (h Handler) Delete(w http.ResponseWriter, r *http.Request) {
+	path := h.resolve(r.URL.Path)
+	s := h.startSession(w, r, "DELETE", path)
+	defer h.endSession(s)
+	w = s.writer()
+
+	if !h.removeRequest(w, r, "DELETE", path) {
+		return
+	}
+	defer h.release(path)
+
+	if err := h.remove(path); err != nil {
+		h.storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remove deletes the file at path and its status, and ends the streams of its
+// followers. The caller must have reserved path.
+func (h Handler) remove(path string) error {
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := h.storage().Remove(path); err != nil {
+		return err
+	}
+	h.addUsage(-fi.Size())
+	h.removeStatus(path)
+	h.endFollowers(path)
+	h.notify(StreamEvent{Type: "deleted", Path: path})
+	return nil
+}
+
+// Rotate handles ROTATE requests (sent with the POST method), which archive a
+// file (and its status) under the first unused name formed by adding the
+// suffix ".httpfstream-archive.1", ".httpfstream-archive.2", etc., to its path,
+// and replace it with an empty file. The response body contains the path of
+// the archive. Archives can be followed and deleted, but not appended to or
+// rotated. If the file has an active writer, the server responds with HTTP
+// 409. Clients that are still following the file receive the end of the
+// stream, as for Delete.
+func (h Handler) Rotate(w http.ResponseWriter, r *http.Request) {
+	path := h.resolve(r.URL.Path)
+	s := h.startSession(w, r, "ROTATE", path)
+	defer h.endSession(s)
+	w = s.writer()
+
+	if !h.removeRequest(w, r, "ROTATE", path) {
+		return
+	}
+	defer h.release(path)
+
+	var archive string
+	for n := 1; ; n++ {
+		archive = path + archiveSuffix + strconv.Itoa(n)
+		_, err := h.storage().Stat(archive)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			h.storageError(w, err)
+			return
+		}
+	}
+
+	if err := h.storage().Rename(path, archive); err != nil {
+		h.storageError(w, err)
+		return
+	}
+	if err := h.storage().Rename(path+statusSuffix, archive+statusSuffix); err != nil && !os.IsNotExist(err) {
+		h.logError("Failed to archive status", "path", path, "error", err)
+	}
+	f, err := h.storage().Append(path)
+	if err != nil {
+		h.storageError(w, err)
+		return
+	}
+	f.Close()
+
+	h.endFollowers(path)
+	h.notify(StreamEvent{Type: "rotated", Path: path})
+	fmt.Fprintln(w, archive)
+}
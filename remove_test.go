@@ -0,0 +1,236 @@
+package httpfstream
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDelete(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	if err := Delete(u); err != os.ErrNotExist {
+		t.Errorf("Delete nonexistent: want error %v, got %v", os.ErrNotExist, err)
+	}
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "foo")
+	waitForWrite()
+	if err := Delete(u); err != ErrWriterConflict {
+		t.Errorf("Delete with active writer: want error %v, got %v", ErrWriterConflict, err)
+	}
+	w.Abort("oops")
+	waitForWrite()
+
+	if err := Delete(u); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := Follow(u); err != os.ErrNotExist {
+		t.Errorf("Follow deleted: want error %v, got %v", os.ErrNotExist, err)
+	}
+
+	// The status of the deleted stream is gone, too.
+	if _, err := os.Stat(filepath.Join(server.dir, "file"+statusSuffix)); !os.IsNotExist(err) {
+		t.Errorf("want status removed, got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "foo")
+	waitForWrite()
+	if _, err := Rotate(u); err != ErrWriterConflict {
+		t.Errorf("Rotate with active writer: want error %v, got %v", ErrWriterConflict, err)
+	}
+	w.Abort("oops")
+	waitForWrite()
+
+	for i, want := range []string{"/file" + archiveSuffix + "1", "/file" + archiveSuffix + "2"} {
+		archive, err := Rotate(u)
+		if err != nil {
+			t.Fatalf("Rotate: %s", err)
+		}
+		if archive.Path != want || archive.Host != u.Host {
+			t.Errorf("Rotate: want archive %s, got %s", want, archive)
+		}
+
+		r, err := Follow(archive)
+		if err != nil {
+			t.Fatalf("Follow archive: %s", err)
+		}
+		if i == 0 {
+			// The first archive has the data and status of the stream.
+			if data := string(limitRead(t, r, 3)); data != "foo" {
+				t.Errorf("want archived data %q, got %q", "foo", data)
+			}
+			checkEndOfStream(t, "archive", r, &AbortError{Reason: "oops"})
+		} else {
+			checkEndOfStream(t, "archive", r, nil)
+		}
+		r.Close()
+
+		// Archives can't be appended to, so clients can't write streams
+		// that collide with them.
+		if _, err := OpenAppend(archive); err == nil {
+			t.Errorf("OpenAppend %s: want error", archive)
+		}
+	}
+
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow rotated: %s", err)
+	}
+	defer r.Close()
+	checkEndOfStream(t, "rotated", r, nil)
+}
+
+// TestRemove_resuming checks that followers of a stream that is deleted or
+// rotated while it waits to be resumed always end with the reason "stream
+// removed".
+func TestRemove_resuming(t *testing.T) {
+	t.Parallel()
+	server := newTestServerWith(func(h *Handler) { h.ResumeTimeout = 5 * time.Second })
+	defer server.close()
+
+	su, _ := url.Parse(server.URL)
+	proxy := newDropProxy(t, su.Host)
+	defer proxy.close()
+
+	for _, remove := range []func(u *url.URL) error{
+		Delete,
+		func(u *url.URL) error { _, err := Rotate(u); return err },
+	} {
+		u, _ := url.Parse(server.URL + "/file")
+		pu, _ := url.Parse("http://" + proxy.Addr().String() + "/file")
+		w, err := OpenAppend(pu)
+		if err != nil {
+			t.Fatalf("OpenAppend: %s", err)
+		}
+		io.WriteString(w, "foo")
+		waitForWrite()
+
+		r, err := Follow(u)
+		if err != nil {
+			t.Fatalf("Follow: %s", err)
+		}
+		limitRead(t, r, 3)
+		proxy.drop()
+		waitForWrite()
+
+		start := time.Now()
+		if err := remove(u); err != nil {
+			t.Fatalf("remove: %s", err)
+		}
+		checkEndOfStream(t, "removed while resuming", r, removedStatus.err())
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("follower waited %s for the end of the removed stream", d)
+		}
+		r.Close()
+		w.Close()
+	}
+}
+
+// recordingSink records the data and status sent to a follower.
+type recordingSink struct {
+	data   []byte
+	status *streamStatus
+}
+
+func (s *recordingSink) write(data []byte, end int64) error {
+	s.data = append(s.data, data...)
+	return nil
+}
+
+func (s *recordingSink) keepalive() error { return nil }
+
+func (s *recordingSink) close(st *streamStatus) error {
+	s.status = st
+	return nil
+}
+
+func (s *recordingSink) abort() {}
+
+func TestEndFollowers(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	w, _ := h.Storage.Append("/file")
+	io.WriteString(w, "foo")
+	if err := h.reserveAs("/file", true); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := h.Storage.Open("/file", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/file", nil)
+	fl := h.addFollower("/file", r)
+	s := new(recordingSink)
+	done := make(chan struct{})
+	go func() {
+		h.follow("/file", f, 0, fl, s)
+		close(done)
+	}()
+
+	h.endFollowers("/file")
+	<-done
+	if string(s.data) != "foo" {
+		t.Errorf("want data %q, got %q", "foo", s.data)
+	}
+	if s.status == nil || *s.status != removedStatus {
+		t.Errorf("want status %+v, got %+v", removedStatus, s.status)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	if err := h.reserve("/file"); err != nil {
+		t.Fatal(err)
+	}
+	if h.isWriting("/file") {
+		t.Error("want reserved path not reported as being written")
+	}
+	if err := h.addWriter("/file"); err != ErrWriterConflict {
+		t.Errorf("addWriter: want error %v, got %v", ErrWriterConflict, err)
+	}
+	h.release("/file")
+
+	if err := h.addWriter("/file"); err != nil {
+		t.Fatal(err)
+	}
+	if !h.isWriting("/file") {
+		t.Error("want appended path reported as being written")
+	}
+
+	// A reservation that takes over an interrupted stream and doesn't
+	// remove the file aborts the stream when it is released.
+	h.ResumeTimeout = time.Hour
+	h.removeWriter("/file", &disconnectedStatus)
+	if err := h.reserve("/file"); err != nil {
+		t.Fatal(err)
+	}
+	if st := h.readStatus("/file"); st != nil {
+		t.Errorf("want no status while reserved, got %+v", st)
+	}
+	h.release("/file")
+	if st := h.readStatus("/file"); st == nil || *st != disconnectedStatus {
+		t.Errorf("want status %+v after release, got %+v", disconnectedStatus, st)
+	}
+}
@@ -0,0 +1,64 @@
+package httpfstream
+
+import (
+	"time"
+)
+
+// disconnectedStatus is the status with which a stream ends if its writer
+// disconnected without ending it and nobody resumed it.
+var disconnectedStatus = streamStatus{Aborted: true, Reason: "writer disconnected"}
+
+// closedChan is an already-closed channel.
+var closedChan = make(chan struct{})
+
+func init() { close(closedChan) }
+
+// interrupt releases path when its writer disconnects without ending the
+// stream, which is aborted with disconnectedStatus. If h.ResumeTimeout is
+// positive, the stream instead stays open for that long, so that the next
+// writer of path resumes it (see reserve), and is only aborted if nobody does.
+func (h Handler) interrupt(path string) {
+	timeout := h.ResumeTimeout
+
+	h.writersMu.Lock()
+	aw, present := h.writers[path]
+	if !present {
+		h.writersMu.Unlock()
+		return
+	}
+	delete(h.writers, path)
+	if timeout <= 0 {
+		h.writeStatus(path, &disconnectedStatus)
+		close(aw.done)
+		h.writersMu.Unlock()
+		h.notifyAborted(path)
+		return
+	}
+	aw.interrupted = true
+	aw.resumed = make(chan struct{})
+	aw.timer = time.AfterFunc(timeout, func() { h.expire(path, aw) })
+	h.resuming[path] = aw
+	close(aw.done)
+	h.writersMu.Unlock()
+}
+
+// expire aborts the stream of the interrupted writer aw of path, unless it was
+// resumed.
+func (h Handler) expire(path string, aw *activeWriter) {
+	h.writersMu.Lock()
+	if h.resuming[path] != aw {
+		h.writersMu.Unlock()
+		return
+	}
+	delete(h.resuming, path)
+	// Record the status while holding h.writersMu, so that no new writer
+	// starts (and replaces the status) in the meantime.
+	h.writeStatus(path, &disconnectedStatus)
+	close(aw.resumed)
+	h.writersMu.Unlock()
+	h.notifyAborted(path)
+}
+
+func (h Handler) notifyAborted(path string) {
+	h.notify(StreamEvent{Type: "finished", Path: path, Aborted: true, Reason: disconnectedStatus.Reason})
+}
@@ -0,0 +1,96 @@
+package httpfstream
+
+import (
+	"sort"
+	"time"
+)
+
+// A RetentionPolicy limits the streams that a Handler keeps. A zero limit is
+// unlimited. Streams with an active writer are never deleted, but they count
+// toward the limits.
+type RetentionPolicy struct {
+	// MaxAge is the maximum time since a stream was last modified.
+	MaxAge time.Duration
+
+	// MaxBytes is the maximum total size of all streams.
+	MaxBytes int64
+
+	// MaxStreams is the maximum number of streams.
+	MaxStreams int
+}
+
+// Collect deletes the streams that p does not allow h to keep: those older
+// than p.MaxAge and, while there are more than p.MaxStreams streams or they are
+// larger than p.MaxBytes in total, the least recently modified ones. It returns
+// the paths of the deleted streams. Each deletion is logged to h.Log.
+func (h Handler) Collect(p RetentionPolicy) ([]string, error) {
+	streams, err := h.Streams("/")
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byModTime(streams))
+
+	var total int64
+	for _, s := range streams {
+		total += s.Size
+	}
+	count := len(streams)
+
+	now := time.Now()
+	var deleted []string
+	for _, s := range streams {
+		expired := p.MaxAge > 0 && now.Sub(s.ModTime) > p.MaxAge
+		over := (p.MaxStreams > 0 && count > p.MaxStreams) || (p.MaxBytes > 0 && total > p.MaxBytes)
+		if !expired && !over {
+			// The remaining streams are newer, so they are not expired
+			// either.
+			break
+		}
+		if s.Writing {
+			continue
+		}
+
+		if err := h.reserve(s.Path); err != nil {
+			// A writer started since the streams were listed.
+			continue
+		}
+		err := h.remove(s.Path)
+		h.release(s.Path)
+		if err != nil {
+			h.logError("Retention: failed to delete stream", "path", s.Path, "error", err)
+			continue
+		}
+		h.logInfo("Retention: deleted stream", "path", s.Path, "bytes", s.Size, "mod_time", s.ModTime.Format(time.RFC3339))
+		deleted = append(deleted, s.Path)
+		count--
+		total -= s.Size
+	}
+	return deleted, nil
+}
+
+// StartJanitor enforces p by calling h.Collect(p) every interval, in a new
+// goroutine, until stop is called.
+func (h Handler) StartJanitor(p RetentionPolicy, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := h.Collect(p); err != nil {
+					h.logError("Retention: failed to list streams", "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+type byModTime []StreamInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime.Before(s[j].ModTime) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
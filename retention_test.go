@@ -0,0 +1,110 @@
+package httpfstream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeAged writes a file of the given size under dir, last modified age ago.
+func writeAged(t *testing.T, dir, name string, size int, age time.Duration) {
+	path := filepath.Join(dir, name)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	tests := []struct {
+		policy RetentionPolicy
+
+		// deleted is the streams deleted while /oldest has an active writer,
+		// and then is the streams deleted after the writer finishes.
+		deleted, then []string
+	}{
+		{policy: RetentionPolicy{}},
+		{policy: RetentionPolicy{MaxAge: 90 * time.Minute}, deleted: []string{"/a/old", "/older"}, then: []string{"/oldest"}},
+		{policy: RetentionPolicy{MaxStreams: 3}, deleted: []string{"/a/old"}},
+		{policy: RetentionPolicy{MaxStreams: 1}, deleted: []string{"/a/old", "/older", "/new"}},
+		{policy: RetentionPolicy{MaxBytes: 25}, deleted: []string{"/a/old", "/older"}},
+		{policy: RetentionPolicy{MaxAge: time.Hour, MaxStreams: 3}, deleted: []string{"/a/old", "/older"}, then: []string{"/oldest"}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "httpfstream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAged(t, dir, "new", 10, 0)
+		writeAged(t, dir, "older", 10, 2*time.Hour)
+		writeAged(t, dir, "a/old", 10, 3*time.Hour)
+		writeAged(t, dir, "oldest", 10, 4*time.Hour)
+
+		h := New(dir)
+		if err := h.reserve("/oldest"); err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := h.Collect(test.policy)
+		if err != nil {
+			t.Fatalf("%+v: Collect: %s", test.policy, err)
+		}
+		if !reflect.DeepEqual(deleted, test.deleted) {
+			t.Errorf("%+v: want deleted %v, got %v", test.policy, test.deleted, deleted)
+		}
+		for _, path := range deleted {
+			if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+				t.Errorf("%+v: want %s deleted, got %v", test.policy, path, err)
+			}
+		}
+
+		h.release("/oldest")
+		deleted, err = h.Collect(test.policy)
+		if err != nil {
+			t.Fatalf("%+v: Collect: %s", test.policy, err)
+		}
+		if !reflect.DeepEqual(deleted, test.then) {
+			t.Errorf("%+v: after the writer finished: want deleted %v, got %v", test.policy, test.then, deleted)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStartJanitor(t *testing.T) {
+	t.Parallel()
+	var h Handler
+	server := newTestServerWith(func(hh *Handler) { h = *hh })
+	defer server.close()
+
+	writeAged(t, server.dir, "old", 3, time.Hour)
+
+	u, _ := url.Parse(server.URL + "/live")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "foo")
+	waitForWrite()
+	mtime := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(server.dir, "live"), mtime, mtime)
+
+	stop := h.StartJanitor(RetentionPolicy{MaxAge: time.Minute}, 5*time.Millisecond)
+	defer stop()
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := os.Stat(filepath.Join(server.dir, "old")); !os.IsNotExist(err) {
+		t.Errorf("want expired stream deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(server.dir, "live")); err != nil {
+		t.Errorf("want stream with active writer kept, got %v", err)
+	}
+}
@@ -3,41 +3,152 @@ package httpfstream
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/garyburd/go-websocket/websocket"
+	"html"
 	"io"
-	"log"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	pathpkg "path"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// New returns a new http.Handler for httpfstream.
+// New returns a new http.Handler for httpfstream that stores files under the
+// root directory on the local file system.
 func New(root string) Handler {
+	h := NewWithStorage(Dir(root))
+	h.Root = root
+	return h
+}
+
+// NewWithStorage returns a new http.Handler for httpfstream that stores files
+// in s.
+func NewWithStorage(s Storage) Handler {
 	return Handler{
-		Root:      root,
-		httpFS:    http.Dir(root),
-		writers:   make(map[string]struct{}),
-		followers: make(map[string]map[*http.Request]chan []byte),
+		Storage:     s,
+		writers:     make(map[string]*activeWriter),
+		resuming:    make(map[string]*activeWriter),
+		writersMu:   new(sync.Mutex),
+		followers:   make(map[string]map[*http.Request]*follower),
+		followersMu: new(sync.Mutex),
+		watchers:    make(map[chan StreamEvent]string),
+		watchersMu:  new(sync.Mutex),
+		tails:       make(map[string]*tailBuffer),
+		tailsMu:     new(sync.Mutex),
+		usage:       new(diskUsage),
+		metrics:     new(metrics),
 	}
 }
 
 type Handler struct {
+	Storage Storage
+
+	// Root is the directory in which files are stored if Storage is nil.
+	//
+	// Deprecated: Set Storage to Dir(root) instead.
 	Root string
-	Log  *log.Logger
 
-	httpFS http.FileSystem
+	// Log, if set, receives log records, including an access log record
+	// (with the message "Access") at the end of each APPEND and FOLLOW
+	// request.
+	Log Logger
+
+	// Authorizer, if set, decides whether each request may APPEND to or
+	// FOLLOW a path. If nil, all requests are allowed.
+	Authorizer Authorizer
+
+	// MaxStreamBytes, if positive, is the maximum size of a file. Appending
+	// stops when a file reaches it, and the stream is aborted.
+	MaxStreamBytes int64
+
+	// MaxMessageBytes, if positive, is the maximum size of a WebSocket message
+	// sent by an appender. A larger message is discarded, and the stream is
+	// aborted.
+	MaxMessageBytes int64
+
+	// MaxTotalBytes, if positive, is the maximum total size of all files.
+	// Appending stops when it is reached, as for MaxStreamBytes.
+	MaxTotalBytes int64
+
+	// FollowerBufferSize is the number of appended messages that are
+	// buffered for each follower. If zero, 50 are buffered.
+	FollowerBufferSize int
+
+	// SlowFollowers is the policy for followers whose buffers are full
+	// because they don't receive data as fast as it is appended.
+	SlowFollowers SlowFollowerPolicy
 
-	writers   map[string]struct{}
-	writersMu sync.Mutex
+	// SlowFollowerTimeout is the time for which the writer waits for slow
+	// followers under BlockSlowFollowers. It bounds the wait for each
+	// append, not for each follower: in the worst case, every append is
+	// delayed by SlowFollowerTimeout. If zero, DefaultSlowFollowerTimeout is
+	// used.
+	SlowFollowerTimeout time.Duration
 
-	followers   map[string]map[*http.Request]chan []byte
-	followersMu sync.Mutex
+	// ResumeTimeout is the time for which a stream stays open after its writer
+	// disconnects without ending it, so that the writer (such as an Appender)
+	// can reconnect and resume it. Followers keep following the stream in the
+	// meantime. If nobody resumes the stream, it is aborted with the reason
+	// "writer disconnected", so followers learn that the writer crashed up
+	// to ResumeTimeout later. If zero (or negative), the stream is aborted as
+	// soon as the writer disconnects.
+	ResumeTimeout time.Duration
+
+	// TailBufferSize is the number of bytes of the most recently appended
+	// data that are kept in memory for each file with an active writer.
+	// Followers that start at an offset within that data are served from
+	// memory instead of from storage. If zero, no data is kept.
+	TailBufferSize int
+
+	usage   *diskUsage
+	metrics *metrics
+
+	// writers maps each path that has an active writer to the writer, and
+	// resuming maps each path whose writer was interrupted to the writer,
+	// until the stream is resumed or ResumeTimeout passes.
+	writers   map[string]*activeWriter
+	resuming  map[string]*activeWriter
+	writersMu *sync.Mutex
+
+	followers   map[string]map[*http.Request]*follower
+	followersMu *sync.Mutex
+
+	tails   map[string]*tailBuffer
+	tailsMu *sync.Mutex
+
+	// watchers maps the channel of each client that WATCHes for stream
+	// events to the path it watches.
+	watchers   map[chan StreamEvent]string
+	watchersMu *sync.Mutex
 }
 
-const xVerb = "X-Verb"
+const (
+	xVerb   = "X-Verb"
+	xOffset = "X-Offset"
+	xAck    = "X-Ack"
+
+	// xBinary is sent (with the value "1") by clients that send and receive
+	// file data in binary WebSocket messages. The server echoes it in the
+	// handshake response to confirm. Otherwise, file data is sent in text
+	// messages, which is what older clients expect.
+	xBinary = "X-Binary"
+)
+
+// dataOp returns the type of WebSocket message that carries file data on a
+// connection, given the header of the request (on the server) or response (on
+// the client) of the WebSocket handshake.
+func dataOp(header http.Header) int {
+	if header.Get(xBinary) == "1" {
+		return websocket.OpBinary
+	}
+	return websocket.OpText
+}
 
 // ServeHTTP implements net/http.Handler.
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -51,20 +162,29 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		switch verb {
 		case "APPEND":
 			h.Append(w, r)
+		case "LIST":
+			h.List(w, r)
+		case "WATCH":
+			h.Watch(w, r)
 		default:
 			h.Follow(w, r)
 		}
+	case "POST":
+		switch verb {
+		case "ROTATE":
+			h.Rotate(w, r)
+		default:
+			h.Append(w, r)
+		}
+	case "PUT":
+		h.Append(w, r)
+	case "DELETE":
+		h.Delete(w, r)
 	default:
 		http.Error(w, "method not supported", http.StatusMethodNotAllowed)
 	}
 }
 
-func (h Handler) logf(msg string, v ...interface{}) {
-	if h.Log != nil {
-		h.Log.Printf(msg, v...)
-	}
-}
-
 const (
 	readBufSize  = 10 * 1024 // 10 kb
 	writeBufSize = 10 * 1024 // 10 kb
@@ -78,44 +198,143 @@ var (
 	writeWait               = 5 * time.Second
 )
 
+// storage returns h.Storage, or the directory h.Root if h.Storage is nil.
+func (h Handler) storage() Storage {
+	if h.Storage == nil {
+		return Dir(h.Root)
+	}
+	return h.Storage
+}
+
 func (h Handler) resolve(path string) string {
-	path = pathpkg.Clean("/" + path)
-	return filepath.Join(string(h.Root), path)
+	return pathpkg.Clean("/" + path)
 }
 
-// ErrWriterConflict indicates that the requested path is currently being
-// written by another writer. A path may have at most one active writer.
-var ErrWriterConflict = errors.New("path already has an active writer")
+// An activeWriter is the writer of a path, or another request (such as a
+// DELETE) that reserved the path.
+type activeWriter struct {
+	// done is closed when the writer finishes, which wakes up the path's
+	// followers.
+	done chan struct{}
 
-func (h Handler) addWriter(path string) error {
+	// interrupted is set before done is closed if the writer disconnected
+	// without ending its stream. Then resumed is closed when another writer
+	// resumes the stream, which is next, or when the stream is aborted
+	// instead, in which case next is nil.
+	interrupted bool
+	resumed     chan struct{}
+	next        *activeWriter
+	timer       *time.Timer
+
+	// appending is set if the writer is an APPEND session, rather than a
+	// reservation that keeps writers out (e.g., while the file is deleted).
+	appending bool
+
+	// If a reservation took over the stream of an interrupted writer,
+	// tookOver is set, and removed is set once the stream's followers were
+	// ended because the file was removed (see endFollowers).
+	tookOver, removed bool
+}
+
+// reserve marks path as having an active writer, or returns ErrWriterConflict
+// if it already has one. The reservation isn't reported as a writer. If the
+// path's last writer was interrupted, the reservation takes over its stream,
+// which is aborted when the reservation is released unless the file was
+// removed in the meantime.
+func (h Handler) reserve(path string) error {
+	return h.reserveAs(path, false)
+}
+
+// reserveAs is like reserve. If appending is set, the new writer is an APPEND
+// session, which resumes the stream of an interrupted writer.
+func (h Handler) reserveAs(path string, appending bool) error {
 	h.writersMu.Lock()
-	defer h.writersMu.Unlock()
-	if _, present := h.writers[path]; !present {
-		h.writers[path] = struct{}{}
+	if _, present := h.writers[path]; present {
+		h.writersMu.Unlock()
+		return ErrWriterConflict
+	}
+	aw := &activeWriter{done: make(chan struct{}), appending: appending}
+	h.writers[path] = aw
+	prev := h.resuming[path]
+	if prev == nil {
+		h.writersMu.Unlock()
 		return nil
 	}
-	return ErrWriterConflict
+	prev.timer.Stop()
+	delete(h.resuming, path)
+	prev.next = aw
+	aw.tookOver = !appending
+	close(prev.resumed)
+	h.writersMu.Unlock()
+	return nil
 }
 
-func (h Handler) removeWriter(path string) {
+func (h Handler) release(path string) {
 	h.writersMu.Lock()
-	defer h.writersMu.Unlock()
+	aw, present := h.writers[path]
+	if !present {
+		h.writersMu.Unlock()
+		return
+	}
 	delete(h.writers, path)
+	abort := aw.tookOver && !aw.removed
+	if abort {
+		// The interrupted stream that the reservation took over still
+		// exists, so end it as though nobody had resumed it.
+		h.writeStatus(path, &disconnectedStatus)
+	}
+	close(aw.done)
+	h.writersMu.Unlock()
+	if abort {
+		h.notifyAborted(path)
+	}
+}
+
+// ErrWriterConflict indicates that the requested path is currently being
+// written by another writer. A path may have at most one active writer.
+var ErrWriterConflict = errors.New("path already has an active writer")
+
+func (h Handler) addWriter(path string) error {
+	if err := h.reserveAs(path, true); err != nil {
+		return err
+	}
+	h.notify(StreamEvent{Type: "writing", Path: path})
+	return nil
 }
 
-func (h Handler) addFollower(path string, r *http.Request, c chan []byte) {
+// removeWriter releases path when its writer ends with status st. If the
+// writer disconnected without ending the stream, the stream may be resumed
+// (see interrupt).
+func (h Handler) removeWriter(path string, st *streamStatus) {
+	if st != nil && *st == disconnectedStatus {
+		h.interrupt(path)
+		return
+	}
+	h.release(path)
+
+	e := StreamEvent{Type: "finished", Path: path}
+	if st := h.readStatus(path); st != nil {
+		e.Aborted, e.Reason = st.Aborted, st.Reason
+	}
+	h.notify(e)
+}
+
+// addFollower registers a new follower of path for the request r.
+func (h Handler) addFollower(path string, r *http.Request) *follower {
+	fl := h.newFollower()
 	h.followersMu.Lock()
 	defer h.followersMu.Unlock()
 	if _, present := h.followers[path]; !present {
-		h.followers[path] = make(map[*http.Request]chan []byte)
+		h.followers[path] = make(map[*http.Request]*follower)
 	}
-	h.followers[path][r] = c
+	h.followers[path][r] = fl
+	return fl
 }
 
-func (h Handler) getFollowers(path string) []chan []byte {
+func (h Handler) getFollowers(path string) []*follower {
 	h.followersMu.Lock()
 	defer h.followersMu.Unlock()
-	fs := make([]chan []byte, len(h.followers[path]))
+	fs := make([]*follower, len(h.followers[path]))
 	i := 0
 	for _, f := range h.followers[path] {
 		fs[i] = f
@@ -127,43 +346,201 @@ func (h Handler) getFollowers(path string) []chan []byte {
 func (h Handler) removeFollower(path string, r *http.Request) {
 	h.followersMu.Lock()
 	defer h.followersMu.Unlock()
+	if fl, present := h.followers[path][r]; present {
+		close(fl.done)
+	}
 	delete(h.followers[path], r)
 	if len(h.followers[path]) == 0 {
 		delete(h.followers, path)
 	}
 }
 
+// isWriting reports whether path has an active APPEND session or is waiting
+// for one to resume its stream.
 func (h Handler) isWriting(path string) bool {
+	return h.getWriter(path) != nil
+}
+
+// getWriter returns the active writer of path, or its interrupted writer if
+// the stream is waiting to be resumed, or nil if it has neither.
+func (h Handler) getWriter(path string) *activeWriter {
 	h.writersMu.Lock()
 	defer h.writersMu.Unlock()
-	_, present := h.writers[path]
-	return present
+	if aw := h.writers[path]; aw != nil && aw.appending {
+		return aw
+	}
+	return h.resuming[path]
+}
+
+// requestOffset returns the byte offset at which the client wants to start
+// reading, specified in the X-Offset header or the "offset" query parameter.
+func requestOffset(r *http.Request) (int64, error) {
+	s := r.Header.Get(xOffset)
+	if s == "" {
+		s = r.URL.Query().Get("offset")
+	}
+	if s == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errors.New("invalid offset " + strconv.Quote(s))
+	}
+	return offset, nil
+}
+
+// serveFile serves the file's contents over plain HTTP. If offset is nonzero
+// and the request has no Range header, only the contents starting at offset are
+// served, as though the client had requested the range "bytes=offset-".
+func (h Handler) serveFile(w http.ResponseWriter, r *http.Request, offset int64) {
+	path := h.resolve(r.URL.Path)
+
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		h.storageError(w, err)
+		return
+	}
+
+	if fi.IsDir() {
+		h.serveDir(w, r, path)
+		return
+	}
+
+	if offset != 0 && r.Header.Get("Range") == "" {
+		if offset == fi.Size() {
+			// There is no data after offset, which is not an error but can't
+			// be expressed as a satisfiable byte range.
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	f, err := h.storage().Open(path, 0)
+	if err != nil {
+		h.storageError(w, err)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
 }
 
-func (h Handler) serveFile(w http.ResponseWriter, r *http.Request) {
-	http.FileServer(h.httpFS).ServeHTTP(w, r)
+func (h Handler) serveDir(w http.ResponseWriter, r *http.Request, path string) {
+	fis, err := h.storage().List(path)
+	if err != nil {
+		h.storageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, fi := range fis {
+		if isStatusPath(fi.Name()) {
+			continue
+		}
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// storageError writes an HTTP error response for an error returned by
+// h.Storage.
+func (h Handler) storageError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	default:
+		h.logError("Storage error", "error", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
 }
 
 // Follow handles FOLLOW requests to retrieve the contents of a file and a
-// real-time stream of data that is appended to the file.
+// real-time stream of data that is appended to the file. If the request
+// specifies an offset (in the X-Offset header or the "offset" query
+// parameter), the contents before that byte offset are skipped. If it asks for
+// the last N bytes or lines of the file instead (in the X-Tail-Bytes or
+// X-Tail-Lines header, or the "tail-bytes" or "tail-lines" query parameter),
+// the contents before them are skipped, and the offset is ignored.
+//
+// Clients that send "Accept: text/event-stream" receive the data as
+// Server-Sent Events (see followEvents). Other clients that don't request a
+// WebSocket receive the data in a chunked HTTP response, which continues until
+// the writer finishes (see followHTTP), unless they send a Range header, in
+// which case they receive a snapshot of the file.
 func (h Handler) Follow(w http.ResponseWriter, r *http.Request) {
 	path := h.resolve(r.URL.Path)
-	h.logf("FOLLOW %s", path)
+	s := h.startSession(w, r, "FOLLOW", path)
+	defer h.endSession(s)
+	w = s.writer()
+
+	if !h.authorize(w, r, "FOLLOW", path) {
+		return
+	}
+
+	if isStatusPath(path) {
+		http.NotFound(w, r)
+		return
+	}
+
+	offset, err := requestOffset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, lines, err := requestTail(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n != -1 {
+		if offset, err = h.tailOffset(path, n, lines); err != nil {
+			h.storageError(w, err)
+			return
+		}
+	}
+
+	if acceptsEventStream(r) {
+		s.bytes = h.followEvents(w, r, path, offset)
+		return
+	}
 
 	// If this file isn't currently being written to, we don't need to update to
 	// a WebSocket; we can just return the static file.
-	if !h.isWriting(path) {
-		h.serveFile(w, r)
+	if !h.isWriting(path) || r.Header.Get("Range") != "" {
+		h.setPathStatusHeader(w.Header(), path)
+		h.serveFile(w, r, offset)
+		s.bytes = s.written
 		return
 	}
 
-	c := make(chan []byte)
-	h.addFollower(path, r, c)
-	defer h.removeFollower(path, r)
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		h.storageError(w, err)
+		return
+	}
+	if offset > fi.Size() {
+		http.Error(w, ErrOffsetOutOfRange.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
 
-	// TODO(sqs): race conditions galore
+	// Register the follower before reading the file, so that all data is
+	// either already in the file when it is read or broadcast to the
+	// follower afterwards (or both, in which case follow skips the data that
+	// it has already sent).
+	fl := h.addFollower(path, r)
+	defer h.removeFollower(path, r)
 
-	f, err := os.Open(path)
+	f, err := h.storage().Open(path, offset)
 	if err != nil {
 		http.Error(w, "failed to open file: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -171,129 +548,401 @@ func (h Handler) Follow(w http.ResponseWriter, r *http.Request) {
 	defer f.Close()
 
 	// Open WebSocket.
-	ws, err := websocket.Upgrade(w, r.Header, nil, readBufSize, writeBufSize)
+	endMarker := r.Header.Get(xEndMarker) == "1"
+	respHeader := make(http.Header)
+	if endMarker {
+		respHeader.Set(xEndMarker, "1")
+	}
+	if dataOp(r.Header) == websocket.OpBinary {
+		respHeader.Set(xBinary, "1")
+	}
+	ws, err := websocket.Upgrade(w, r.Header, respHeader, readBufSize, writeBufSize)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); ok {
-			// Serve file via HTTP (not WebSocket).
-			h.serveFile(w, r)
+			// Stream file via HTTP (not WebSocket).
+			atomic.AddInt64(&h.metrics.httpFallbacks, 1)
+			s.bytes = h.followHTTP(w, r, path, f, offset, fl)
 			return
 		}
-		h.logf("failed to upgrade to WebSocket: %s", err)
+		atomic.AddInt64(&h.metrics.followUpgradeFailures, 1)
+		h.logWarn("Failed to upgrade to WebSocket", "verb", "FOLLOW", "path", path, "error", err)
 		return
 	}
 	defer ws.Close()
 
-	// Send persisted file contents.
-	for {
-		sw, err := ws.NextWriter(websocket.OpText)
-		if err != nil {
-			h.logf("NextWriter for file failed: %s", err)
-			return
-		}
+	s.bytes = h.follow(path, f, offset, fl, &webSocketSink{ws, dataOp(r.Header), endMarker})
+}
 
-		n, err := io.Copy(sw, f)
-		if err != nil {
-			h.logf("File write to WebSocket failed: %s", err)
-			sw.Close()
-			return
-		}
+// A followSink sends a followed file's data to a follower.
+type followSink interface {
+	// write sends data, which ends at offset end in the file. It is never
+	// called with empty data.
+	write(data []byte, end int64) error
 
-		err = sw.Close()
-		if err != nil {
-			h.logf("Failed to close WebSocket file writer: %s", err)
-			return
-		}
+	// keepalive sends a message to keep the connection open when there is no
+	// data to send.
+	keepalive() error
 
-		// Finished reading file.
-		if n == 0 {
-			break
-		}
+	// close ends the stream. st is the status of the stream, or nil if it is
+	// unknown.
+	close(st *streamStatus) error
+
+	// abort ends the stream abnormally, so that the follower can tell that
+	// it didn't receive the whole stream.
+	abort()
+}
+
+// follow sends the persisted contents of f (the file at path) from offset to
+// s, followed by the data received by fl for as long as the file has an active
+// writer. It returns the number of bytes of data sent.
+//
+// fl must be registered before f is read. follow keeps track of the offset of
+// the next byte to send, and it sends each chunk of data that it receives from
+// that offset on, so no data is sent twice. If there is a gap between that
+// offset and the start of a chunk, or when the writer finishes, the missing
+// data is read from f.
+func (h Handler) follow(path string, f File, offset int64, fl *follower, s followSink) (sent int64) {
+	start := offset
+	defer func() { sent = offset - start }()
+
+	// Send persisted file contents.
+	var err error
+	if offset, err = h.copyFile(path, f, offset, s); err != nil {
+		return
 	}
 
-	// Follow new writes to file.
-	var lastPing time.Time
+	// Follow new writes to file until the writer finishes. If the writer is
+	// interrupted, wait for the next writer to resume the stream.
+	aw := h.getWriter(path)
+	wait, resuming := closedChan, false
+	if aw != nil {
+		wait = aw.done
+	}
+	keepalive := time.NewTicker(followKeepaliveInterval)
+	defer keepalive.Stop()
+	var st *streamStatus
 	for {
-		tick := time.NewTicker(50 * time.Millisecond)
 		select {
-		case <-tick.C:
-			if !h.isWriting(path) {
+		case <-wait:
+			switch {
+			case aw == nil:
+				goto done
+			case !resuming && aw.interrupted:
+				wait, resuming = aw.resumed, true
+			case resuming && aw.next != nil:
+				aw, resuming = aw.next, false
+				wait = aw.done
+			default:
 				goto done
 			}
-			if time.Since(lastPing) > followKeepaliveInterval {
-				ws.WriteMessage(websocket.OpPing, []byte{})
-				lastPing = time.Now()
-			}
-		case data := <-c:
-			sw, err := ws.NextWriter(websocket.OpText)
-			if err != nil {
-				h.logf("NextWriter failed: %s", err)
+		case <-keepalive.C:
+			if err := s.keepalive(); err != nil {
+				atomic.AddInt64(&h.metrics.droppedFollowers, 1)
+				h.logWarn("Keepalive to follower failed", "path", path, "error", err)
 				return
 			}
-
-			_, err = sw.Write(data)
+		case ch, ok := <-fl.c:
+			if !ok {
+				st = &removedStatus
+				goto done
+			}
+			if ch.end-int64(len(ch.data)) > offset {
+				if offset, err = h.copyFile(path, f, offset, s); err != nil {
+					return
+				}
+			}
+			if ch.end <= offset {
+				continue
+			}
+			data := ch.data[int64(len(ch.data))-(ch.end-offset):]
+			err := s.write(data, ch.end)
 			if err != nil {
-				h.logf("Write to WebSocket failed: %s", err)
-				sw.Close()
+				atomic.AddInt64(&h.metrics.droppedFollowers, 1)
+				h.logWarn("Write to follower failed", "path", path, "error", err)
 				return
 			}
-
-			err = sw.Close()
-			if err != nil {
-				h.logf("Failed to close WebSocket writer: %s", err)
+			offset = ch.end
+			atomic.AddInt64(&h.metrics.fanoutBytes, int64(len(data)))
+		case <-fl.lagged:
+			if offset, err = h.copyFile(path, f, offset, s); err != nil {
 				return
 			}
+		case <-fl.dropped:
+			atomic.AddInt64(&h.metrics.disconnectedSlowFollowers, 1)
+			h.logWarn("Disconnecting slow follower", "path", path, "offset", offset)
+			s.abort()
+			return
 		}
 	}
 
 done:
-	err = ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+	if st == nil && fl.removed() {
+		st = &removedStatus
+	}
+	if st == nil {
+		// Send the data that the follower hasn't received yet (because it
+		// was dropped or is still buffered) before ending the stream.
+		if offset, err = h.copyFile(path, f, offset, s); err != nil {
+			return
+		}
+		st = h.readStatus(path)
+	}
+	err = s.close(st)
 	if err != nil {
-		h.logf("Failed to close WebSocket: %s", err)
-		return
+		h.logWarn("Failed to end stream to follower", "path", path, "error", err)
 	}
+	return
+}
 
-	err = f.Close()
+// followHTTP streams the contents of f (which is positioned at offset in the
+// file at path), followed by the data received on c for as long as the file has
+// an active writer, in a chunked HTTP response. The status of the stream is
+// reported in the X-Stream-Status and X-Stream-Reason trailers. It returns the
+// number of bytes of data sent.
+func (h Handler) followHTTP(w http.ResponseWriter, r *http.Request, path string, f File, offset int64, fl *follower) int64 {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		// Streaming isn't possible, so serve a snapshot.
+		h.serveFile(w, r, offset)
+		return 0
+	}
+
+	ctype := mime.TypeByExtension(pathpkg.Ext(path))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Trailer", xStreamStatus+", "+xStreamReason)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return h.follow(path, f, offset, fl, &httpStreamSink{w, flusher, r})
+}
+
+// httpStreamSink sends a followed file's data in an HTTP response body.
+type httpStreamSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	r       *http.Request
+}
+
+func (s *httpStreamSink) write(data []byte, end int64) error {
+	_, err := s.w.Write(data)
 	if err != nil {
-		h.logf("Failed to close destination file: %s", err)
-		return
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *httpStreamSink) keepalive() error {
+	// Nothing can be sent without altering the data, but this is a good time
+	// to notice that the client has gone away.
+	select {
+	case <-s.r.Context().Done():
+		return s.r.Context().Err()
+	default:
+		return nil
+	}
+}
+
+func (s *httpStreamSink) close(st *streamStatus) error {
+	if st != nil {
+		setStatusHeader(s.w.Header(), st)
+	}
+	return nil
+}
+
+func (s *httpStreamSink) abort() {
+	// Break off the response, instead of ending it normally.
+	panic(http.ErrAbortHandler)
+}
+
+// webSocketSink sends a followed file's data over a WebSocket.
+type webSocketSink struct {
+	ws *websocket.Conn
+	op int // type of data messages
+
+	// endMarker is whether the client accepts end-of-stream markers.
+	endMarker bool
+}
+
+func (s *webSocketSink) write(data []byte, end int64) error {
+	s.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.ws.WriteMessage(s.op, data)
+}
+
+func (s *webSocketSink) keepalive() error {
+	s.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.ws.WriteMessage(websocket.OpPing, []byte{})
+}
+
+func (s *webSocketSink) close(st *streamStatus) error {
+	if s.endMarker && st != nil {
+		err := writeEndMarker(s.ws, st)
+		if err != nil {
+			return err
+		}
 	}
+	return s.ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Time{})
+}
+
+func (s *webSocketSink) abort() {
+	// The caller closes the connection without a close message.
 }
 
 // Append handles APPEND requests and appends data to a file.
+//
+// The WebSocket handshake response includes the current size of the file in
+// the X-Offset header. If the request has the header "X-Ack: 1", then after
+// each message is persisted, the server replies with a text message containing
+// the new size of the file (in decimal), which lets the client determine which
+// data has been committed.
+//
+// If the request has the header "X-End-Marker: 1", the client may end the
+// stream with an end-of-stream marker, and the resulting status is persisted
+// for followers.
+//
+// APPEND requests may also be sent without a WebSocket, as a POST request
+// whose body (typically sent with chunked transfer encoding) is appended to the
+// file. A PUT request with a Content-Range header of the form "bytes START-..."
+// is handled the same way, but only if START equals the current size of the
+// file; otherwise, the server responds with HTTP 416 and the current size in
+// the X-Offset header. See appendBody.
+//
+// If the file (or the server's storage) is already at its size limit (see
+// MaxStreamBytes and MaxTotalBytes), the server responds with HTTP 413. The
+// WebSocket handshake response reports the limits on the size of the file and
+// of each message in the X-Max-Size and X-Max-Message-Size headers. A message
+// that would exceed a limit is discarded. The server sends the appender an
+// end-of-stream marker with the reason (if it accepts markers), which is also
+// the reason with which the stream is aborted, and closes the WebSocket with
+// the close code 1009 (message too big) or 1008 (policy violation).
+//
+// If the file already has an active writer, the server responds with HTTP 409,
+// or with HTTP 403 (as it used to) to WebSocket clients that don't send any of
+// the X-Ack, X-End-Marker and X-Binary headers.
 func (h Handler) Append(w http.ResponseWriter, r *http.Request) {
 	path := h.resolve(r.URL.Path)
-	h.logf("APPEND %s", path)
+	sess := h.startSession(w, r, "APPEND", path)
+	defer h.endSession(sess)
+	w = sess.writer()
 
 	defer r.Body.Close()
 
+	if !h.authorize(w, r, "APPEND", path) {
+		return
+	}
+
+	if isStatusPath(path) || isArchivePath(path) {
+		http.Error(w, "path is reserved", http.StatusForbidden)
+		return
+	}
+
+	start := int64(-1)
+	if r.Method == "PUT" {
+		var err error
+		start, err = contentRangeStart(r.Header.Get("Content-Range"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	err := h.addWriter(path)
 	if err != nil {
-		h.logf("addWriter %s: %s", err)
-		http.Error(w, "addWriter: "+err.Error(), http.StatusForbidden)
+		h.logInfo("APPEND refused", "path", path, "remote_addr", r.RemoteAddr, "error", err)
+		http.Error(w, "addWriter: "+err.Error(), conflictStatus(r))
 		return
 	}
-	defer h.removeWriter(path)
+	var status *streamStatus
+	defer func() { h.removeWriter(path, status) }()
 
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	if err != nil {
-		http.Error(w, "failed to create dir: "+err.Error(), http.StatusInternalServerError)
+	var size int64
+	fi, err := h.storage().Stat(path)
+	created := os.IsNotExist(err)
+	if err == nil {
+		size = fi.Size()
+	} else if !created {
+		h.storageError(w, err)
+		return
+	}
+	if start != -1 && start != size {
+		w.Header().Set(xOffset, strconv.FormatInt(size, 10))
+		http.Error(w, "Content-Range start does not match file size", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if reason, full := h.quotaFull(size); full || (r.Method != "GET" && h.MaxStreamBytes > 0 && size+r.ContentLength > h.MaxStreamBytes) {
+		if !full {
+			reason = reasonStreamLimit
+		}
+		h.logInfo("APPEND refused", "path", path, "remote_addr", r.RemoteAddr, "reason", reason)
+		w.Header().Set(xOffset, strconv.FormatInt(size, 10))
+		http.Error(w, reason, http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	// Record the data appended and the outcome in the access log.
+	initialSize := size
+	defer func() {
+		sess.bytes, sess.result = size-initialSize, status
+	}()
+
+	// Forget the status of the previous stream, and record the status of this
+	// one (if known) before followers learn that it has ended. If the writer
+	// disconnected, the status is recorded only if the stream isn't resumed.
+	h.removeStatus(path)
+	defer func() {
+		if status != nil && *status != disconnectedStatus {
+			h.writeStatus(path, status)
+		}
+	}()
+
+	h.startTail(path, size)
+	defer h.endTail(path)
+
+	f, err := h.storage().Append(path)
 	if err != nil {
 		http.Error(w, "failed to open destination file for writing: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
+	if created {
+		h.notify(StreamEvent{Type: "created", Path: path})
+	}
 
-	ws, err := websocket.Upgrade(w, r.Header, nil, readBufSize, writeBufSize)
+	if r.Method != "GET" {
+		size, status = h.appendBody(w, r, path, f, size)
+		return
+	}
+
+	endMarker := r.Header.Get(xEndMarker) == "1"
+	if endMarker {
+		status = &disconnectedStatus
+	}
+	ack := r.Header.Get(xAck) == "1"
+
+	respHeader := http.Header{xOffset: []string{strconv.FormatInt(size, 10)}}
+	if endMarker {
+		respHeader.Set(xEndMarker, "1")
+	}
+	if dataOp(r.Header) == websocket.OpBinary {
+		respHeader.Set(xBinary, "1")
+	}
+	if h.MaxStreamBytes > 0 {
+		respHeader.Set(xMaxSize, strconv.FormatInt(h.MaxStreamBytes, 10))
+	}
+	if h.MaxMessageBytes > 0 {
+		respHeader.Set(xMaxMessageSize, strconv.FormatInt(h.MaxMessageBytes, 10))
+	}
+	ws, err := websocket.Upgrade(w, r.Header, respHeader, readBufSize, writeBufSize)
 	if err != nil {
+		atomic.AddInt64(&h.metrics.appendUpgradeFailures, 1)
 		if _, ok := err.(websocket.HandshakeError); ok {
-			h.logf("not a WebSocket handshake: %s", err)
+			h.logInfo("Not a WebSocket handshake", "verb", "APPEND", "path", path, "error", err)
 			return
 		}
-		h.logf("failed to upgrade to WebSocket: %s", err)
+		h.logWarn("Failed to upgrade to WebSocket", "verb", "APPEND", "path", path, "error", err)
 		return
 	}
 	defer ws.Close()
@@ -302,43 +951,186 @@ func (h Handler) Append(w http.ResponseWriter, r *http.Request) {
 	for {
 		op, rd, err := ws.NextReader()
 		if err != nil {
-			if err != io.ErrUnexpectedEOF {
-				h.logf("NextReader failed: %s", err)
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				h.logWarn("NextReader failed", "path", path, "error", err)
 			}
 			break
 		}
 		switch op {
 		case websocket.OpPong:
 			ws.SetReadDeadline(time.Now().Add(readWait))
-		case websocket.OpText:
+		case websocket.OpText, websocket.OpBinary:
+			// Read the whole message before persisting any of it, so that a
+			// message that exceeds a limit is discarded entirely.
 			var buf bytes.Buffer
-			mw := io.MultiWriter(f, &buf)
+			if h.MaxMessageBytes > 0 {
+				rd = io.LimitReader(rd, h.MaxMessageBytes+1)
+			}
+			n, err := io.Copy(&buf, rd)
+			if err != nil {
+				h.logWarn("Read from WebSocket failed", "path", path, "error", err)
+				return
+			}
+			if h.MaxMessageBytes > 0 && n > h.MaxMessageBytes {
+				status = h.refuseAppend(ws, path, endMarker, websocket.CloseMessageTooBig, reasonMessageTooLarge)
+				goto done
+			}
+
+			if n == 0 {
+				if endMarker && isEndMarker(op, dataOp(r.Header), n) {
+					status, err = readEndStatus(ws)
+					if err != nil {
+						h.logWarn("Failed to read end-of-stream marker", "path", path, "error", err)
+						status = &streamStatus{Aborted: true, Reason: "invalid end-of-stream marker"}
+					}
+					// Tell the appender that the stream ended, so that it
+					// doesn't wait for the connection to close.
+					ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+					goto done
+				}
+				continue
+			}
+
+			if allotted, reason := h.allot(size, n); allotted < n {
+				h.addUsage(-allotted)
+				status = h.refuseAppend(ws, path, endMarker, websocket.ClosePolicyViolation, reason)
+				goto done
+			}
 
 			// Persist to file.
-			_, err := io.Copy(mw, rd)
-			if err != nil {
-				h.logf("Read from WebSocket failed: %s", err)
+			if _, err := f.Write(buf.Bytes()); err != nil {
+				h.addUsage(-n)
+				h.logError("Failed to write to destination file", "path", path, "error", err)
 				return
 			}
+			size += n
+			atomic.AddInt64(&h.metrics.appendedBytes, n)
 
 			// Broadcast to followers.
-			followers := h.getFollowers(path)
-			for _, fc := range followers {
-				fc <- buf.Bytes()
+			h.broadcast(path, buf.Bytes(), size)
+
+			// Acknowledge the data that was persisted.
+			if ack {
+				ws.SetWriteDeadline(time.Now().Add(writeWait))
+				err = ws.WriteMessage(websocket.OpText, []byte(strconv.FormatInt(size, 10)))
+				if err != nil {
+					h.logWarn("Failed to send acknowledgement", "path", path, "error", err)
+					return
+				}
 			}
 			ws.SetReadDeadline(time.Now().Add(readWait))
 		}
 	}
 
+done:
 	err = r.Body.Close()
 	if err != nil {
-		h.logf("failed to close upload stream: %s", err)
+		h.logWarn("Failed to close upload stream", "path", path, "error", err)
 		return
 	}
 
 	err = f.Close()
 	if err != nil {
-		h.logf("failed to close destination file: %s", err)
+		h.logError("Failed to close destination file", "path", path, "error", err)
 		return
 	}
 }
+
+// refuseAppend ends an APPEND WebSocket session whose data exceeds a limit,
+// sending the appender a close message with the given code and reason. If the
+// appender accepts end-of-stream markers, the refusal is first sent in-band, as
+// a marker with the aborted status of the stream, which is returned.
+func (h Handler) refuseAppend(ws *websocket.Conn, path string, endMarker bool, code int, reason string) *streamStatus {
+	h.logInfo("APPEND refused", "path", path, "reason", reason)
+	st := &streamStatus{Aborted: true, Reason: reason}
+	if endMarker {
+		if err := writeEndMarker(ws, st); err != nil {
+			h.logWarn("Failed to send end-of-stream marker to appender", "path", path, "error", err)
+		}
+	}
+	ws.WriteControl(websocket.OpClose, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	return st
+}
+
+// appendBody appends the request body to f (the file at path, whose current
+// size is size) and broadcasts it to followers as it is received. It responds
+// with the committed size of the file, both in the X-Offset header and as the
+// response body. If the body exceeds a size limit, the part that fits is
+// appended, and the server responds with HTTP 413 (and the committed size in
+// the X-Offset header). It returns the new size of the file and the status of
+// the stream.
+func (h Handler) appendBody(w http.ResponseWriter, r *http.Request, path string, f io.Writer, size int64) (int64, *streamStatus) {
+	buf := make([]byte, readBufSize)
+	for {
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			allotted, reason := h.allot(size, int64(n))
+			if allotted > 0 {
+				_, werr := f.Write(buf[:allotted])
+				if werr != nil {
+					h.addUsage(-allotted)
+					h.logError("Failed to write to destination file", "path", path, "error", werr)
+					http.Error(w, "failed to write to destination file: "+werr.Error(), http.StatusInternalServerError)
+					return size, &streamStatus{Aborted: true, Reason: "failed to write to destination file"}
+				}
+				size += allotted
+				atomic.AddInt64(&h.metrics.appendedBytes, allotted)
+
+				// Followers may still be using the data after it's
+				// broadcast, so don't reuse buf.
+				h.broadcast(path, buf[:allotted], size)
+				buf = make([]byte, readBufSize)
+			}
+			if reason != "" {
+				h.logInfo("APPEND refused", "path", path, "remote_addr", r.RemoteAddr, "reason", reason)
+				w.Header().Set(xOffset, strconv.FormatInt(size, 10))
+				http.Error(w, reason, http.StatusRequestEntityTooLarge)
+				return size, &streamStatus{Aborted: true, Reason: reason}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.logWarn("Read from request body failed", "path", path, "error", err)
+			http.Error(w, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+			return size, &disconnectedStatus
+		}
+	}
+
+	sizeStr := strconv.FormatInt(size, 10)
+	w.Header().Set(xOffset, sizeStr)
+	fmt.Fprintln(w, sizeStr)
+	return size, &streamStatus{}
+}
+
+// conflictStatus returns the HTTP status of the response to an APPEND request r
+// for a file that already has an active writer. Older clients, which only
+// recognize HTTP 403, are identified by not sending any of the headers that
+// were added since.
+func conflictStatus(r *http.Request) int {
+	if r.Method == "GET" && r.Header.Get(xAck) == "" && r.Header.Get(xEndMarker) == "" && r.Header.Get(xBinary) == "" {
+		return http.StatusForbidden
+	}
+	return http.StatusConflict
+}
+
+// contentRangeStart returns the first byte position in a Content-Range header
+// of the form "bytes START-END/LENGTH" (where END and LENGTH may be "*" or
+// omitted, since the length of an appended stream may not be known in
+// advance).
+func contentRangeStart(s string) (int64, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return 0, errors.New("invalid Content-Range " + strconv.Quote(s))
+	}
+	spec := s[len(prefix):]
+	if i := strings.Index(spec, "-"); i != -1 {
+		spec = spec[:i]
+	}
+	start, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil || start < 0 {
+		return 0, errors.New("invalid Content-Range " + strconv.Quote(s))
+	}
+	return start, nil
+}
@@ -0,0 +1,138 @@
+package httpfstream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const eventStreamType = "text/event-stream"
+
+// acceptsEventStream reports whether the client requested a Server-Sent Events
+// stream.
+func acceptsEventStream(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err == nil && mediatype == eventStreamType {
+			return true
+		}
+	}
+	return false
+}
+
+// followEvents handles FOLLOW requests over Server-Sent Events. It sends the
+// persisted contents of the file and then the data appended to it, as events
+// whose IDs are the byte offset in the file of the end of their data. When the
+// stream ends, it sends an "end" event whose data is a JSON object such as
+// {"aborted":true,"reason":"..."} (or {} if the stream finished successfully or
+// its status is unknown).
+//
+// A message event's data is the file data as text. Data that can't be
+// represented in an event's text (because it is not valid UTF-8 or it contains
+// a carriage return) is sent in a "base64" event instead, whose data is
+// base64-encoded.
+//
+// Because event IDs are offsets, a reconnecting client that sends the
+// Last-Event-ID header resumes where it left off.
+//
+// It returns the number of bytes of data sent.
+func (h Handler) followEvents(w http.ResponseWriter, r *http.Request, path string, offset int64) int64 {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		offset, err = strconv.ParseInt(id, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid Last-Event-ID "+strconv.Quote(id), http.StatusBadRequest)
+			return 0
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return 0
+	}
+
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		h.storageError(w, err)
+		return 0
+	}
+	if offset > fi.Size() {
+		http.Error(w, ErrOffsetOutOfRange.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return 0
+	}
+
+	// Register the follower before reading the file, as in Follow.
+	fl := h.addFollower(path, r)
+	defer h.removeFollower(path, r)
+
+	f, err := h.storage().Open(path, offset)
+	if err != nil {
+		http.Error(w, "failed to open file: "+err.Error(), http.StatusInternalServerError)
+		return 0
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", eventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return h.follow(path, f, offset, fl, &eventStreamSink{w, flusher})
+}
+
+// eventStreamSink sends a followed file's data as Server-Sent Events.
+type eventStreamSink struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s *eventStreamSink) write(data []byte, end int64) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d\n", end)
+	if utf8.Valid(data) && bytes.IndexByte(data, '\r') == -1 {
+		for _, line := range strings.Split(string(data), "\n") {
+			fmt.Fprintf(&buf, "data: %s\n", line)
+		}
+	} else {
+		fmt.Fprintf(&buf, "event: base64\ndata: %s\n", base64.StdEncoding.EncodeToString(data))
+	}
+	buf.WriteString("\n")
+	return s.send(buf.Bytes())
+}
+
+func (s *eventStreamSink) keepalive() error {
+	return s.send([]byte(":\n\n"))
+}
+
+func (s *eventStreamSink) close(st *streamStatus) error {
+	if st == nil {
+		st = &streamStatus{}
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.send([]byte("event: end\ndata: " + string(data) + "\n\n"))
+}
+
+func (s *eventStreamSink) abort() {
+	// Break off the response, so that the client reconnects (with the ID of
+	// the last event it received).
+	panic(http.ErrAbortHandler)
+}
+
+func (s *eventStreamSink) send(p []byte) error {
+	_, err := s.w.Write(p)
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
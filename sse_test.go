@@ -0,0 +1,140 @@
+package httpfstream
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type event struct {
+	id, typ, data string
+}
+
+// readEvent reads the next Server-Sent Event from br, skipping comments.
+func readEvent(t *testing.T, br *bufio.Reader) event {
+	var e event
+	var data []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("readEvent: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if data == nil && e.id == "" && e.typ == "" {
+				continue
+			}
+			e.data = strings.Join(data, "\n")
+			if e.typ == "" {
+				e.typ = "message"
+			}
+			return e
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i != -1 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			e.id = value
+		case "event":
+			e.typ = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+func getEvents(t *testing.T, u *url.URL, lastEventID string) *http.Response {
+	req, _ := http.NewRequest("GET", u.String(), nil)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %s", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: HTTP status %d", u, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("GET %s: want Content-Type text/event-stream, got %q", u, ct)
+	}
+	return resp
+}
+
+func TestFollowEvents(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/stream")
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "foo\nbar")
+	waitForWrite()
+
+	resp := getEvents(t, u, "")
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+
+	want := []event{
+		{id: "7", typ: "message", data: "foo\nbar"},
+		{id: "9", typ: "base64", data: base64.StdEncoding.EncodeToString([]byte("\r\n"))},
+		{id: "11", typ: "message", data: "é"},
+		{typ: "end", data: "{}"},
+	}
+	if e := readEvent(t, br); e != want[0] {
+		t.Errorf("want persisted event %+v, got %+v", want[0], e)
+	}
+	io.WriteString(w, "\r\n")
+	if e := readEvent(t, br); e != want[1] {
+		t.Errorf("want live event %+v, got %+v", want[1], e)
+	}
+	io.WriteString(w, "é")
+	if e := readEvent(t, br); e != want[2] {
+		t.Errorf("want live event %+v, got %+v", want[2], e)
+	}
+	w.Close()
+	if e := readEvent(t, br); e != want[3] {
+		t.Errorf("want end event %+v, got %+v", want[3], e)
+	}
+}
+
+func TestFollowEvents_lastEventID(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/file")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "foobar")
+	w.Abort("oops")
+	waitForWrite()
+
+	resp := getEvents(t, u, "3")
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+
+	if want, got := (event{id: "6", typ: "message", data: "bar"}), readEvent(t, br); want != got {
+		t.Errorf("want event %+v, got %+v", want, got)
+	}
+	if want, got := (event{typ: "end", data: `{"aborted":true,"reason":"oops"}`}), readEvent(t, br); want != got {
+		t.Errorf("want end event %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,206 @@
+package httpfstream
+
+import (
+	"encoding/json"
+	"github.com/garyburd/go-websocket/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// A stream can end with an explicit end-of-stream marker, which records
+// whether the writer finished successfully or aborted. Because WebSocket close
+// frames can't carry this information reliably, the marker is sent in-band: an
+// empty text message followed by a text message containing the JSON-encoded
+// streamStatus. When file data is sent in binary messages (see xBinary), only
+// an empty text message starts a marker, and empty binary messages are
+// ignored. Otherwise, any empty message starts a marker, so writers never send
+// empty data messages. A client opts in by sending the "X-End-Marker: 1" header, and
+// the server confirms that it supports markers by echoing the header in the
+// WebSocket handshake response. Without that confirmation, neither side sends
+// or interprets markers.
+//
+// An appender sends the marker just before it closes the connection. If it
+// opted in and disconnects without sending one, the stream is considered
+// aborted. The server persists the status next to the file and sends the
+// marker to followers when the stream ends. Over plain HTTP, the status of a
+// finished stream is reported in the X-Stream-Status ("ok" or "aborted") and
+// X-Stream-Reason response headers.
+const (
+	xEndMarker    = "X-End-Marker"
+	xStreamStatus = "X-Stream-Status"
+	xStreamReason = "X-Stream-Reason"
+)
+
+// statusSuffix is appended to a file's path to obtain the path at which the
+// status of its last stream is persisted.
+const statusSuffix = ".httpfstream-status"
+
+// streamStatus describes how a stream ended.
+type streamStatus struct {
+	Aborted bool   `json:"aborted,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// err returns the error that followers should receive at the end of a stream
+// with this status.
+func (st *streamStatus) err() error {
+	if st.Aborted {
+		return &AbortError{Reason: st.Reason}
+	}
+	return nil
+}
+
+// An AbortError is returned to followers when the writer aborted the stream
+// (or disconnected without ending it).
+type AbortError struct {
+	Reason string
+}
+
+func (e *AbortError) Error() string {
+	if e.Reason == "" {
+		return "stream aborted"
+	}
+	return "stream aborted: " + e.Reason
+}
+
+// isStatusPath reports whether path is reserved for persisting a stream's
+// status, or is under such a path. Such paths aren't streams.
+func isStatusPath(path string) bool {
+	return strings.Contains(path+"/", statusSuffix+"/")
+}
+
+// readStatus returns the persisted status of the last stream written to path,
+// or nil if there is none (e.g., because the writer did not opt in to
+// end-of-stream markers).
+func (h Handler) readStatus(path string) *streamStatus {
+	f, err := h.storage().Open(path+statusSuffix, 0)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			h.logError("Failed to open status", "path", path, "error", err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	var st streamStatus
+	if err := json.NewDecoder(f).Decode(&st); err != nil {
+		h.logError("Failed to read status", "path", path, "error", err)
+		return nil
+	}
+	return &st
+}
+
+func (h Handler) writeStatus(path string, st *streamStatus) {
+	w, err := h.storage().Append(path + statusSuffix)
+	if err != nil {
+		h.logError("Failed to open status", "path", path, "error", err)
+		return
+	}
+	defer w.Close()
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		h.logError("Failed to write status", "path", path, "error", err)
+	}
+}
+
+func (h Handler) removeStatus(path string) {
+	err := h.storage().Remove(path + statusSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		h.logError("Failed to remove status", "path", path, "error", err)
+	}
+}
+
+// setPathStatusHeader sets the X-Stream-Status and X-Stream-Reason headers to
+// report the status of the last stream written to path, if known.
+func (h Handler) setPathStatusHeader(header http.Header, path string) {
+	if st := h.readStatus(path); st != nil {
+		setStatusHeader(header, st)
+	}
+}
+
+// setStatusHeader sets the X-Stream-Status and X-Stream-Reason headers to
+// report st.
+func setStatusHeader(header http.Header, st *streamStatus) {
+	if st.Aborted {
+		header.Set(xStreamStatus, "aborted")
+		if st.Reason != "" {
+			header.Set(xStreamReason, st.Reason)
+		}
+	} else {
+		header.Set(xStreamStatus, "ok")
+	}
+}
+
+// statusFromHeader returns the error reported by the X-Stream-Status and
+// X-Stream-Reason headers, or nil if the stream did not abort.
+func statusFromHeader(header http.Header) error {
+	if header.Get(xStreamStatus) == "aborted" {
+		return &AbortError{Reason: header.Get(xStreamReason)}
+	}
+	return nil
+}
+
+// writeEndMarker sends the end-of-stream marker with the given status on ws.
+func writeEndMarker(ws *websocket.Conn, st *streamStatus) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := ws.WriteMessage(websocket.OpText, []byte{}); err != nil {
+		return err
+	}
+	return ws.WriteMessage(websocket.OpText, data)
+}
+
+// isEndMarker reports whether a message of type op with n bytes starts an
+// end-of-stream marker on a connection whose data messages have type dataOp.
+func isEndMarker(op, dataOp int, n int64) bool {
+	return n == 0 && (op == websocket.OpText || dataOp == websocket.OpText)
+}
+
+// readEndStatus reads the status message that follows the empty message of an
+// end-of-stream marker.
+func readEndStatus(ws *websocket.Conn) (*streamStatus, error) {
+	_, rdr, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+	var st streamStatus
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// statusReadCloser reads an HTTP response body. At the end of the body, it
+// returns the error reported by the response's X-Stream-Status and
+// X-Stream-Reason headers or trailers, if any, in place of io.EOF.
+type statusReadCloser struct {
+	resp *http.Response
+}
+
+// Read implements io.Reader.
+func (r *statusReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.resp.Body.Read(p)
+	if err == io.EOF {
+		if serr := statusFromHeader(r.resp.Header); serr != nil {
+			err = serr
+		} else if serr := statusFromHeader(r.resp.Trailer); serr != nil {
+			err = serr
+		}
+	}
+	return
+}
+
+// Close implements io.Closer.
+func (r *statusReadCloser) Close() error {
+	return r.resp.Body.Close()
+}
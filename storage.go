@@ -0,0 +1,327 @@
+package httpfstream
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage persists the data of the files that a Handler serves. Paths passed
+// to Storage methods are clean, slash-separated and rooted (e.g., "/foo/bar").
+type Storage interface {
+	// Append opens the named file for appending, creating it (and any parent
+	// directories) if it does not exist.
+	Append(path string) (io.WriteCloser, error)
+
+	// Open opens the named file for reading, positioned at offset.
+	Open(path string, offset int64) (File, error)
+
+	// Stat returns a FileInfo describing the named file or directory.
+	Stat(path string) (os.FileInfo, error)
+
+	// List returns the entries of the named directory, sorted by name.
+	List(path string) ([]os.FileInfo, error)
+
+	// Remove deletes the named file.
+	Remove(path string) error
+
+	// Rename renames (moves) the file oldpath to newpath, replacing newpath
+	// if it exists.
+	Rename(oldpath, newpath string) error
+}
+
+// File is a file opened for reading from a Storage.
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Dir implements Storage using the native file system restricted to a
+// specific directory tree.
+type Dir string
+
+func (d Dir) resolve(path string) string {
+	return filepath.Join(string(d), filepath.FromSlash(pathpkg.Clean("/"+path)))
+}
+
+// Append implements Storage.
+func (d Dir) Append(path string) (io.WriteCloser, error) {
+	name := d.resolve(path)
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// Open implements Storage.
+func (d Dir) Open(path string, offset int64) (File, error) {
+	f, err := os.Open(d.resolve(path))
+	if err != nil {
+		return nil, err
+	}
+	if offset != 0 {
+		_, err = f.Seek(offset, os.SEEK_SET)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Stat implements Storage.
+func (d Dir) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(d.resolve(path))
+}
+
+// List implements Storage.
+func (d Dir) List(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(d.resolve(path))
+}
+
+// Remove implements Storage.
+func (d Dir) Remove(path string) error {
+	return os.Remove(d.resolve(path))
+}
+
+// Rename implements Storage.
+func (d Dir) Rename(oldpath, newpath string) error {
+	return os.Rename(d.resolve(oldpath), d.resolve(newpath))
+}
+
+// MemStorage implements Storage in memory. It is intended for tests.
+type MemStorage struct {
+	files map[string]*memFile
+	mu    sync.Mutex
+}
+
+// NewMemStorage returns a new, empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[string]*memFile)}
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (s *MemStorage) clean(path string) string {
+	return pathpkg.Clean("/" + path)
+}
+
+// Append implements Storage.
+func (s *MemStorage) Append(path string) (io.WriteCloser, error) {
+	path = s.clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isDir(path) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: errors.New("is a directory")}
+	}
+	if _, present := s.files[path]; !present {
+		s.files[path] = &memFile{modTime: time.Now()}
+	}
+	return &memWriter{s, path}, nil
+}
+
+// Open implements Storage.
+func (s *MemStorage) Open(path string, offset int64) (File, error) {
+	path = s.clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, present := s.files[path]; !present {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &memReader{s: s, path: path, off: offset}, nil
+}
+
+// Stat implements Storage.
+func (s *MemStorage) Stat(path string) (os.FileInfo, error) {
+	path = s.clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, present := s.files[path]; present {
+		return memFileInfo{name: pathpkg.Base(path), size: int64(len(f.data)), modTime: f.modTime}, nil
+	}
+	if s.isDir(path) {
+		return memFileInfo{name: pathpkg.Base(path), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+// List implements Storage.
+func (s *MemStorage) List(path string) ([]os.FileInfo, error) {
+	path = s.clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isDir(path) {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: os.ErrNotExist}
+	}
+
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	entries := make(map[string]os.FileInfo)
+	for name, f := range s.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, "/"); i != -1 {
+			entries[rest[:i]] = memFileInfo{name: rest[:i], dir: true}
+		} else {
+			entries[rest] = memFileInfo{name: rest, size: int64(len(f.data)), modTime: f.modTime}
+		}
+	}
+
+	fis := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		fis = append(fis, fi)
+	}
+	sort.Sort(byName(fis))
+	return fis, nil
+}
+
+// Remove implements Storage.
+func (s *MemStorage) Remove(path string) error {
+	path = s.clean(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, present := s.files[path]; !present {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	delete(s.files, path)
+	return nil
+}
+
+// Rename implements Storage.
+func (s *MemStorage) Rename(oldpath, newpath string) error {
+	oldpath, newpath = s.clean(oldpath), s.clean(newpath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, present := s.files[oldpath]
+	if !present {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if s.isDir(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("is a directory")}
+	}
+	delete(s.files, oldpath)
+	s.files[newpath] = f
+	return nil
+}
+
+// isDir reports whether path is the root or a parent of a file in s. The
+// caller must hold s.mu.
+func (s *MemStorage) isDir(path string) bool {
+	if path == "/" {
+		return true
+	}
+	prefix := path + "/"
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type memWriter struct {
+	s    *MemStorage
+	path string
+}
+
+// Write implements io.Writer.
+func (w *memWriter) Write(p []byte) (n int, err error) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	f, present := w.s.files[w.path]
+	if !present {
+		return 0, &os.PathError{Op: "write", Path: w.path, Err: os.ErrNotExist}
+	}
+	f.data = append(f.data, p...)
+	f.modTime = time.Now()
+	return len(p), nil
+}
+
+// Close implements io.Closer.
+func (w *memWriter) Close() error { return nil }
+
+type memReader struct {
+	s    *MemStorage
+	path string
+	off  int64
+}
+
+// Read implements io.Reader.
+func (r *memReader) Read(p []byte) (n int, err error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	f, present := r.s.files[r.path]
+	if !present {
+		return 0, io.EOF
+	}
+	if r.off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, f.data[r.off:])
+	r.off += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (r *memReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += r.off
+	case os.SEEK_END:
+		r.s.mu.Lock()
+		if f, present := r.s.files[r.path]; present {
+			offset += int64(len(f.data))
+		}
+		r.s.mu.Unlock()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *memReader) Close() error { return nil }
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0600
+}
+
+type byName []os.FileInfo
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
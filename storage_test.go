@@ -0,0 +1,150 @@
+package httpfstream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "httpfstream")
+	if err != nil {
+		t.Fatal("TempDir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStorage(t, Dir(dir))
+}
+
+func TestMemStorage(t *testing.T) {
+	t.Parallel()
+	testStorage(t, NewMemStorage())
+}
+
+func testStorage(t *testing.T, s Storage) {
+	if _, err := s.Stat("/a/b"); !os.IsNotExist(err) {
+		t.Errorf("Stat nonexistent: want IsNotExist error, got %v", err)
+	}
+	if _, err := s.Open("/a/b", 0); !os.IsNotExist(err) {
+		t.Errorf("Open nonexistent: want IsNotExist error, got %v", err)
+	}
+
+	for _, data := range []string{"foo", "bar"} {
+		w, err := s.Append("/a/b")
+		if err != nil {
+			t.Fatalf("Append: %s", err)
+		}
+		if _, err := io.WriteString(w, data); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+	}
+
+	fi, err := s.Stat("/a/b")
+	if err != nil {
+		t.Fatalf("Stat: %s", err)
+	}
+	if fi.Name() != "b" || fi.Size() != 6 || fi.IsDir() {
+		t.Errorf("Stat: want file b of size 6, got name %q size %d dir %v", fi.Name(), fi.Size(), fi.IsDir())
+	}
+
+	f, err := s.Open("/a/b", 2)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if data := string(readAll(t, f)); data != "obar" {
+		t.Errorf("Open at offset 2: want %q, got %q", "obar", data)
+	}
+	f.Close()
+
+	fis, err := s.List("/")
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "a" || !fis[0].IsDir() {
+		t.Errorf("List: want only dir a, got %v", fis)
+	}
+
+	if err := s.Rename("/a/b", "/a/c"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if _, err := s.Stat("/a/b"); !os.IsNotExist(err) {
+		t.Errorf("Stat renamed: want IsNotExist error, got %v", err)
+	}
+	if err := s.Rename("/a/b", "/a/d"); !os.IsNotExist(err) {
+		t.Errorf("Rename nonexistent: want IsNotExist error, got %v", err)
+	}
+
+	if err := s.Remove("/a/c"); err != nil {
+		t.Fatalf("Remove: %s", err)
+	}
+	if _, err := s.Stat("/a/c"); !os.IsNotExist(err) {
+		t.Errorf("Stat removed: want IsNotExist error, got %v", err)
+	}
+}
+
+func TestStream_MemStorage(t *testing.T) {
+	t.Parallel()
+
+	h := NewWithStorage(NewMemStorage())
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/foo")
+	if _, err := Follow(u); err != os.ErrNotExist {
+		t.Errorf("Follow nonexistent: want error %v, got %v", os.ErrNotExist, err)
+	}
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "foo")
+	waitForWrite()
+
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if data := string(limitRead(t, r, 3)); data != "foo" {
+		t.Errorf("want persisted data %q, got %q", "foo", data)
+	}
+
+	io.WriteString(w, "bar")
+	if data := string(limitRead(t, r, 3)); data != "bar" {
+		t.Errorf("want followed data %q, got %q", "bar", data)
+	}
+	w.Close()
+	waitForWrite()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+	if data := string(readAll(t, resp.Body)); data != "foobar" {
+		t.Errorf("want stored data %q, got %q", "foobar", data)
+	}
+}
+
+func TestHandler_Root(t *testing.T) {
+	h := New("/tmp/a")
+	if h.Root != "/tmp/a" {
+		t.Errorf("want Root %q, got %q", "/tmp/a", h.Root)
+	}
+
+	// Without Storage, files are stored under Root.
+	h.Storage, h.Root = nil, "/tmp/b"
+	if s, ok := h.storage().(Dir); !ok || s != Dir("/tmp/b") {
+		t.Errorf("want storage Dir(%q), got %#v", "/tmp/b", h.storage())
+	}
+}
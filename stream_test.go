@@ -1,10 +1,20 @@
 package httpfstream
 
 import (
+	"bytes"
+	"context"
+	"github.com/garyburd/go-websocket/websocket"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -44,7 +54,7 @@ func TestStream(t *testing.T) {
 
 		// Check that APPEND data is persisted.
 		want := strings.Join(wantdata[:i+1], "")
-		if got := httpGET(t, u); want != got {
+		if got := httpGETSnapshot(t, u); want != got {
 			t.Errorf("want all == %q, got %q", want, got)
 			return
 		}
@@ -66,3 +76,402 @@ func limitRead(t *testing.T, rdr io.Reader, n int64) []byte {
 	}
 	return data
 }
+
+func TestStream_offset(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/stream")
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+
+	io.WriteString(w, "abc")
+	waitForWrite()
+
+	r, err := FollowAt(u, 1)
+	if err != nil {
+		t.Fatalf("FollowAt: %s", err)
+	}
+	defer r.Close()
+
+	if want, got := "bc", string(limitRead(t, r, 2)); want != got {
+		t.Errorf("want persisted data after offset == %q, got %q", want, got)
+	}
+
+	io.WriteString(w, "foo")
+	if want, got := "foo", string(limitRead(t, r, 3)); want != got {
+		t.Errorf("want msg == %q, got %q", want, got)
+	}
+
+	if _, err := FollowAt(u, 7); err != ErrOffsetOutOfRange {
+		t.Errorf("FollowAt beyond end: want error %v, got %v", ErrOffsetOutOfRange, err)
+	}
+}
+
+func TestStream_endOfStream(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	su, _ := url.Parse(server.URL)
+	proxy := newDropProxy(t, su.Host)
+	defer proxy.close()
+
+	tests := []struct {
+		path string
+		end  func(w StreamWriter)
+		err  error
+	}{
+		{path: "/closed", end: func(w StreamWriter) { w.Close() }},
+		{path: "/aborted", end: func(w StreamWriter) { w.Abort("build failed") }, err: &AbortError{Reason: "build failed"}},
+		{path: "/dropped", end: func(w StreamWriter) { proxy.drop() }, err: &AbortError{Reason: "writer disconnected"}},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(server.URL + test.path)
+		pu, _ := url.Parse("http://" + proxy.Addr().String() + test.path)
+
+		w, err := OpenAppend(pu)
+		if err != nil {
+			t.Fatalf("%s: OpenAppend: %s", test.path, err)
+		}
+		io.WriteString(w, "foo")
+		waitForWrite()
+
+		r, err := Follow(u)
+		if err != nil {
+			t.Fatalf("%s: Follow: %s", test.path, err)
+		}
+		if want, got := "foo", string(limitRead(t, r, 3)); want != got {
+			t.Errorf("%s: want msg == %q, got %q", test.path, want, got)
+		}
+
+		test.end(w)
+		checkEndOfStream(t, test.path+": live", r, test.err)
+		r.Close()
+		w.Close()
+
+		// The status should also be reported over plain HTTP.
+		r, err = Follow(u)
+		if err != nil {
+			t.Fatalf("%s: Follow: %s", test.path, err)
+		}
+		if want, got := "foo", string(limitRead(t, r, 3)); want != got {
+			t.Errorf("%s: want body == %q, got %q", test.path, want, got)
+		}
+		checkEndOfStream(t, test.path+": static", r, test.err)
+		r.Close()
+	}
+}
+
+// TestStream_emptyWrite checks that empty writes aren't mistaken for
+// end-of-stream markers.
+func TestStream_emptyWrite(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	writers := map[string]func(u *url.URL) (io.WriteCloser, error){
+		"/openappend": func(u *url.URL) (io.WriteCloser, error) { return OpenAppend(u) },
+		"/appender":   func(u *url.URL) (io.WriteCloser, error) { return NewAppender(u, nil), nil },
+	}
+	for path, open := range writers {
+		u, _ := url.Parse(server.URL + path)
+		w, err := open(u)
+		if err != nil {
+			t.Fatalf("%s: open: %s", path, err)
+		}
+		for _, p := range []string{"", "foo", "", "bar"} {
+			if n, err := io.WriteString(w, p); n != len(p) || err != nil {
+				t.Errorf("%s: Write(%q): want %d, nil, got %d, %v", path, p, len(p), n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("%s: Close: %s", path, err)
+		}
+		waitForWrite()
+
+		r, err := Follow(u)
+		if err != nil {
+			t.Fatalf("%s: Follow: %s", path, err)
+		}
+		if want, got := "foobar", string(limitRead(t, r, 6)); want != got {
+			t.Errorf("%s: want data %q, got %q", path, want, got)
+		}
+		checkEndOfStream(t, path, r, nil)
+		r.Close()
+	}
+
+	// When data is sent in binary messages, an empty binary message is
+	// ignored, and only an empty text message starts a marker.
+	u, _ := url.Parse(server.URL + "/binary")
+	ws, _, err := DefaultClient.open(context.Background(), u, "APPEND", http.Header{xEndMarker: []string{"1"}, xBinary: []string{"1"}})
+	if err != nil {
+		t.Fatalf("APPEND: %s", err)
+	}
+	ws.WriteMessage(websocket.OpBinary, []byte{})
+	ws.WriteMessage(websocket.OpBinary, []byte("foo"))
+	writeEndMarker(ws, &streamStatus{})
+	ws.Close()
+	waitForWrite()
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	if want, got := "foo", string(limitRead(t, r, 3)); want != got {
+		t.Errorf("binary: want data %q, got %q", want, got)
+	}
+	checkEndOfStream(t, "binary", r, nil)
+	r.Close()
+}
+
+func checkEndOfStream(t *testing.T, label string, r io.Reader, want error) {
+	_, err := r.Read(make([]byte, 1))
+	if want == nil {
+		want = io.EOF
+	}
+	if err == nil || err.Error() != want.Error() {
+		t.Errorf("%s: want end-of-stream error %v, got %v", label, want, err)
+	}
+}
+
+func TestAppendHTTP(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/stream")
+
+	// Stream a chunked POST body, and check that it is sent to followers as
+	// it arrives.
+	pr, pw := io.Pipe()
+	respc := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(u.String(), "application/octet-stream", pr)
+		if err != nil {
+			t.Errorf("POST: %s", err)
+		}
+		respc <- resp
+	}()
+	io.WriteString(pw, "foo")
+	waitForWrite()
+
+	r, err := Follow(u)
+	if err != nil {
+		t.Fatalf("Follow: %s", err)
+	}
+	defer r.Close()
+	if want, got := "foo", string(limitRead(t, r, 3)); want != got {
+		t.Errorf("want persisted data %q, got %q", want, got)
+	}
+	io.WriteString(pw, "bar")
+	if want, got := "bar", string(limitRead(t, r, 3)); want != got {
+		t.Errorf("want msg == %q, got %q", want, got)
+	}
+
+	// Only one writer is allowed at a time.
+	if _, err := OpenAppend(u); err != ErrWriterConflict {
+		t.Errorf("OpenAppend during POST: want error %v, got %v", ErrWriterConflict, err)
+	}
+
+	pw.Close()
+	resp := <-respc
+	if resp == nil {
+		return
+	}
+	if want, got := "6\n", string(readAll(t, resp.Body)); want != got {
+		t.Errorf("want POST response %q, got %q", want, got)
+	}
+	resp.Body.Close()
+	checkEndOfStream(t, "POST", r, nil)
+
+	tests := []struct {
+		contentRange string
+		status       int
+		offset       string
+	}{
+		{"bytes 3-*/*", http.StatusRequestedRangeNotSatisfiable, "6"},
+		{"bytes 6-8/*", http.StatusOK, "9"},
+		{"foo", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", u.String(), strings.NewReader("baz"))
+		req.Header.Set("Content-Range", test.contentRange)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("PUT %q: want HTTP status %d, got %d", test.contentRange, test.status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Offset"); got != test.offset {
+			t.Errorf("PUT %q: want X-Offset %q, got %q", test.contentRange, test.offset, got)
+		}
+	}
+
+	if want, got := "foobarbaz", httpGET(t, u); want != got {
+		t.Errorf("want all == %q, got %q", want, got)
+	}
+}
+
+func TestFollowHTTP(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/stream.txt")
+
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	defer w.Close()
+	io.WriteString(w, "foo")
+	waitForWrite()
+
+	// A plain HTTP GET (like `curl -N`) should stream until the writer
+	// finishes.
+	resp, err := http.Get(u.String())
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("want text/plain Content-Type, got %q", ct)
+	}
+	if want, got := "foo", string(limitRead(t, resp.Body, 3)); want != got {
+		t.Errorf("want persisted data %q, got %q", want, got)
+	}
+	io.WriteString(w, "bar")
+	if want, got := "bar", string(limitRead(t, resp.Body, 3)); want != got {
+		t.Errorf("want appended data %q, got %q", want, got)
+	}
+	w.Abort("oops")
+	if rest := readAll(t, resp.Body); len(rest) != 0 {
+		t.Errorf("want no more data, got %q", rest)
+	}
+	if want, got := "aborted", resp.Trailer.Get("X-Stream-Status"); want != got {
+		t.Errorf("want X-Stream-Status trailer %q, got %q", want, got)
+	}
+	if want, got := "oops", resp.Trailer.Get("X-Stream-Reason"); want != got {
+		t.Errorf("want X-Stream-Reason trailer %q, got %q", want, got)
+	}
+}
+
+// TestFollow_concurrent checks that followers that start at any point (and at
+// any offset) while data is being appended receive exactly the data from their
+// offset to the end of the file, with no bytes duplicated or lost between the
+// persisted data and the data that is broadcast to them. Run it with -race.
+func TestFollow_concurrent(t *testing.T) {
+	t.Parallel()
+	const (
+		numStreams  = 4
+		numMessages = 300
+		followEvery = 25 // messages
+		maxRepeat   = 100
+	)
+	// With a follower buffer size of 1, most data is resynced from the file
+	// (or from the tail buffer, if any).
+	configs := []struct {
+		followerBufferSize, tailBufferSize int
+	}{
+		{0, 0},
+		{1, 0},
+		{1, 4096},
+	}
+	for _, config := range configs {
+		server := newTestServerWith(func(h *Handler) {
+			h.Log = nil
+			h.FollowerBufferSize = config.followerBufferSize
+			h.TailBufferSize = config.tailBufferSize
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < numStreams; i++ {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				u, _ := url.Parse(server.URL + path)
+				w, err := OpenAppend(u)
+				if err != nil {
+					t.Errorf("%s: OpenAppend: %s", path, err)
+					return
+				}
+
+				type result struct {
+					offset int64
+					data   []byte
+					err    error
+				}
+				results := make(chan result, numMessages)
+				var followers sync.WaitGroup
+				follow := func(viaHTTP bool) {
+					defer followers.Done()
+					var offset int64
+					if fi, err := os.Stat(filepath.Join(server.dir, path)); err == nil {
+						offset = rand.Int63n(fi.Size() + 1)
+					}
+					var rdr io.ReadCloser
+					var err error
+					if viaHTTP {
+						req, _ := http.NewRequest("GET", u.String(), nil)
+						req.Header.Set(xOffset, strconv.FormatInt(offset, 10))
+						var resp *http.Response
+						if resp, err = http.DefaultClient.Do(req); err == nil {
+							rdr = resp.Body
+						}
+					} else {
+						rdr, err = FollowAt(u, offset)
+					}
+					if err != nil {
+						results <- result{offset, nil, err}
+						return
+					}
+					defer rdr.Close()
+					data, err := ioutil.ReadAll(rdr)
+					results <- result{offset, data, err}
+				}
+
+				for j := 0; j < numMessages; j++ {
+					if j%followEvery == 0 {
+						followers.Add(1)
+						go follow(j%(2*followEvery) == 0)
+					}
+					msg := strings.Repeat(strconv.Itoa(j)+" ", 1+rand.Intn(maxRepeat)) + "\n"
+					if _, err := io.WriteString(w, msg); err != nil {
+						t.Errorf("%s: Write: %s", path, err)
+						break
+					}
+					if rand.Intn(10) == 0 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+				if err := w.Close(); err != nil {
+					t.Errorf("%s: Close: %s", path, err)
+				}
+				followers.Wait()
+				close(results)
+
+				all, err := ioutil.ReadFile(filepath.Join(server.dir, path))
+				if err != nil {
+					t.Errorf("%s: ReadFile: %s", path, err)
+					return
+				}
+				for r := range results {
+					if r.err != nil {
+						t.Errorf("%s: follower at offset %d: %s", path, r.offset, r.err)
+					} else if !bytes.Equal(r.data, all[r.offset:]) {
+						t.Errorf("%s: follower at offset %d received %d bytes, want %d", path, r.offset, len(r.data), len(all)-int(r.offset))
+					}
+				}
+			}("/stream" + strconv.Itoa(i))
+		}
+		wg.Wait()
+		server.close()
+	}
+}
@@ -0,0 +1,203 @@
+package httpfstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// xTailBytes and xTailLines are sent by clients that want to start
+	// following at the last N bytes or the last N lines of a file,
+	// respectively, instead of at an offset (like tail -c and tail -n).
+	xTailBytes = "X-Tail-Bytes"
+	xTailLines = "X-Tail-Lines"
+)
+
+// A tailBuffer holds the most recent data appended to a file with an active
+// writer, so that followers that start (or resync) at a recent offset are
+// served from memory instead of from the file. It is a ring buffer of fixed
+// size.
+type tailBuffer struct {
+	buf []byte
+	end int64 // offset in the file of the end of the data
+	n   int   // number of bytes held (at most len(buf))
+	mu  sync.Mutex
+}
+
+// newTailBuffer returns a tailBuffer that holds up to size bytes of a file
+// whose current size is end.
+func newTailBuffer(size int, end int64) *tailBuffer {
+	return &tailBuffer{buf: make([]byte, size), end: end}
+}
+
+// write records that p was appended to the file.
+func (t *tailBuffer) write(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.end += int64(len(p))
+	if len(p) > len(t.buf) {
+		p = p[len(p)-len(t.buf):]
+	}
+	i := int((t.end - int64(len(p))) % int64(len(t.buf)))
+	n := copy(t.buf[i:], p)
+	copy(t.buf, p[n:])
+	t.n += len(p)
+	if t.n > len(t.buf) {
+		t.n = len(t.buf)
+	}
+}
+
+// readFrom returns a copy of the data from offset to the end of the data that
+// was appended so far, and the offset of its end. It returns false if the data
+// at offset is no longer (or not yet) held.
+func (t *tailBuffer) readFrom(offset int64) ([]byte, int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if offset < t.end-int64(t.n) || offset > t.end {
+		return nil, 0, false
+	}
+	data := make([]byte, t.end-offset)
+	i := int(offset % int64(len(t.buf)))
+	n := copy(data, t.buf[i:])
+	copy(data[n:], t.buf)
+	return data, t.end, true
+}
+
+// data returns a copy of the data held and the offset of its start.
+func (t *tailBuffer) data() ([]byte, int64) {
+	t.mu.Lock()
+	start := t.end - int64(t.n)
+	t.mu.Unlock()
+	data, _, _ := t.readFrom(start)
+	return data, start
+}
+
+// startTail starts keeping the recent data appended to the file at path (whose
+// current size is size) in memory, if h.TailBufferSize is positive. The caller
+// must have reserved path and must call h.endTail when the writer finishes.
+func (h Handler) startTail(path string, size int64) {
+	if h.TailBufferSize <= 0 {
+		return
+	}
+	h.tailsMu.Lock()
+	defer h.tailsMu.Unlock()
+	h.tails[path] = newTailBuffer(h.TailBufferSize, size)
+}
+
+func (h Handler) endTail(path string) {
+	h.tailsMu.Lock()
+	defer h.tailsMu.Unlock()
+	delete(h.tails, path)
+}
+
+// getTail returns the tailBuffer of the file at path, or nil if it has none.
+func (h Handler) getTail(path string) *tailBuffer {
+	h.tailsMu.Lock()
+	defer h.tailsMu.Unlock()
+	return h.tails[path]
+}
+
+// requestTail returns the number of bytes (or lines, if lines is true) at the
+// end of the file that the client wants to read, specified in the X-Tail-Bytes
+// or X-Tail-Lines header or the "tail-bytes" or "tail-lines" query parameter.
+// If the client didn't specify either, n is -1.
+func requestTail(r *http.Request) (n int64, lines bool, err error) {
+	get := func(header, param string) string {
+		if s := r.Header.Get(header); s != "" {
+			return s
+		}
+		return r.URL.Query().Get(param)
+	}
+	s, lines := get(xTailBytes, "tail-bytes"), false
+	if ls := get(xTailLines, "tail-lines"); ls != "" {
+		if s != "" {
+			return -1, false, errors.New("tail bytes and tail lines are mutually exclusive")
+		}
+		s, lines = ls, true
+	}
+	if s == "" {
+		return -1, false, nil
+	}
+	n, err = strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return -1, false, errors.New("invalid tail " + strconv.Quote(s))
+	}
+	return n, lines, nil
+}
+
+// tailOffset returns the offset of the start of the last n bytes (or lines, if
+// lines is true) of the file at path. If the file has a tail buffer that holds
+// the last n lines, they are found in memory.
+func (h Handler) tailOffset(path string, n int64, lines bool) (int64, error) {
+	fi, err := h.storage().Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if !lines {
+		if n > size {
+			return 0, nil
+		}
+		return size - n, nil
+	}
+
+	if t := h.getTail(path); t != nil {
+		data, start := t.data()
+		offset, err := lastLinesOffset(bytes.NewReader(data), int64(len(data)), n)
+		if err != nil {
+			return 0, err
+		}
+		// An offset of 0 means that the tail buffer didn't hold all n
+		// lines (unless it holds the whole file).
+		if offset > 0 || start == 0 {
+			return start + offset, nil
+		}
+	}
+
+	f, err := h.storage().Open(path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return lastLinesOffset(f, size, n)
+}
+
+// lastLinesOffset returns the offset of the start of the last n lines of the
+// first size bytes of r, or 0 if it has n lines or fewer. As in tail -n, a
+// newline at the end doesn't start another line.
+func lastLinesOffset(r io.ReadSeeker, size, n int64) (int64, error) {
+	if n == 0 {
+		return size, nil
+	}
+	buf := make([]byte, readBufSize)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		p := buf[:end-start]
+		if _, err := r.Seek(start, os.SEEK_SET); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(r, p); err != nil {
+			return 0, err
+		}
+		for i := len(p) - 1; i >= 0; i-- {
+			if p[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			n--
+			if n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
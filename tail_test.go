@@ -0,0 +1,197 @@
+package httpfstream
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tb := newTailBuffer(8, 100)
+	tests := []struct {
+		write string
+
+		// from is the offset of the oldest data that should be held.
+		from int64
+		want string
+	}{
+		{"", 100, ""},
+		{"abc", 100, "abc"},
+		{"defgh", 100, "abcdefgh"},
+		{"ij", 102, "cdefghij"},
+		{"klmnopqrstuvwxyz", 118, "stuvwxyz"},
+		{"0", 119, "tuvwxyz0"},
+	}
+	for _, test := range tests {
+		tb.write([]byte(test.write))
+		data, end, ok := tb.readFrom(test.from)
+		if !ok || string(data) != test.want {
+			t.Errorf("after writing %q: want data %q from offset %d, got %q (ok == %v)", test.write, test.want, test.from, data, ok)
+		}
+		if want := test.from + int64(len(test.want)); end != want {
+			t.Errorf("after writing %q: want end %d, got %d", test.write, want, end)
+		}
+		if _, _, ok := tb.readFrom(test.from - 1); ok {
+			t.Errorf("after writing %q: want no data from offset %d", test.write, test.from-1)
+		}
+		if test.want == "" {
+			continue
+		}
+		if data, _, ok := tb.readFrom(end - 1); !ok || string(data) != test.want[len(test.want)-1:] {
+			t.Errorf("after writing %q: want last byte from offset %d, got %q (ok == %v)", test.write, end-1, data, ok)
+		}
+	}
+	if _, _, ok := tb.readFrom(tb.end + 1); ok {
+		t.Error("want no data after the end")
+	}
+}
+
+// unreadableFile is a File that can't be read, for checking that data is
+// served from memory.
+type unreadableFile struct{}
+
+var errUnreadable = errors.New("unreadable")
+
+func (unreadableFile) Read(p []byte) (int, error) { return 0, errUnreadable }
+
+func (unreadableFile) Seek(offset int64, whence int) (int64, error) { return offset, nil }
+
+func (unreadableFile) Close() error { return nil }
+
+func TestFollow_tailBuffer(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	h.TailBufferSize = 4
+	w, _ := h.Storage.Append("/file")
+	io.WriteString(w, "foo")
+	if err := h.reserveAs("/file", true); err != nil {
+		t.Fatal(err)
+	}
+	h.startTail("/file", 3)
+	size := int64(3)
+	for _, s := range []string{"bar", "baz"} {
+		io.WriteString(w, s)
+		size += int64(len(s))
+		h.broadcast("/file", []byte(s), size)
+	}
+
+	// Recent data is served from memory, and older data from the file.
+	for offset, f := range map[int64]File{5: unreadableFile{}, 4: nil} {
+		if f == nil {
+			var err error
+			if f, err = h.Storage.Open("/file", offset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, _ := http.NewRequest("GET", "/file", nil)
+		fl := h.addFollower("/file", r)
+		s := new(recordingSink)
+		done := make(chan struct{})
+		go func() {
+			h.follow("/file", f, offset, fl, s)
+			close(done)
+		}()
+		fl.c <- chunk{[]byte("qux"), 12}
+		h.endFollowers("/file")
+		<-done
+
+		want := "foobarbazqux"[offset:]
+		if string(s.data) != want {
+			t.Errorf("offset %d: want data %q, got %q", offset, want, s.data)
+		}
+	}
+	h.endTail("/file")
+	h.release("/file")
+}
+
+func TestLastLinesOffset(t *testing.T) {
+	long := strings.Repeat("x", readBufSize) + "\n"
+	tests := []struct {
+		data string
+		n    int64
+		want int64
+	}{
+		{"", 1, 0},
+		{"a\nb\nc\n", 0, 6},
+		{"a\nb\nc\n", 1, 4},
+		{"a\nb\nc\n", 2, 2},
+		{"a\nb\nc\n", 3, 0},
+		{"a\nb\nc\n", 4, 0},
+		{"a\nb\nc", 1, 4},
+		{"a\nb\nc", 2, 2},
+		{"a\n\n\n", 2, 2},
+		{"a\n" + long + long, 2, 2},
+		{"a\n" + long + long, 1, int64(2 + len(long))},
+	}
+	for _, test := range tests {
+		offset, err := lastLinesOffset(strings.NewReader(test.data), int64(len(test.data)), test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset != test.want {
+			t.Errorf("%d bytes: want offset of last %d lines %d, got %d", len(test.data), test.n, test.want, offset)
+		}
+	}
+}
+
+func TestFollowTail(t *testing.T) {
+	t.Parallel()
+	for _, tailBufferSize := range []int{0, 4} {
+		server := newTestServerWith(func(h *Handler) { h.TailBufferSize = tailBufferSize })
+
+		u, _ := url.Parse(server.URL + "/log")
+		w, err := OpenAppend(u)
+		if err != nil {
+			t.Fatalf("OpenAppend: %s", err)
+		}
+		io.WriteString(w, "a\nb\nc\n")
+		waitForWrite()
+
+		lines, err := FollowTail(u, 2, true)
+		if err != nil {
+			t.Fatalf("FollowTail: %s", err)
+		}
+		lastBytes, err := FollowTail(u, 3, false)
+		if err != nil {
+			t.Fatalf("FollowTail: %s", err)
+		}
+		if want, got := "b\nc\n", string(limitRead(t, lines, 4)); want != got {
+			t.Errorf("want last 2 lines %q, got %q", want, got)
+		}
+		if want, got := "\nc\n", string(limitRead(t, lastBytes, 3)); want != got {
+			t.Errorf("want last 3 bytes %q, got %q", want, got)
+		}
+		io.WriteString(w, "d\n")
+		w.Close()
+		if want, got := "d\n", string(readAll(t, lines)); want != got {
+			t.Errorf("want appended data %q, got %q", want, got)
+		}
+		if want, got := "d\n", string(readAll(t, lastBytes)); want != got {
+			t.Errorf("want appended data %q, got %q", want, got)
+		}
+
+		// Finished streams are served over plain HTTP.
+		tu, _ := url.Parse(server.URL + "/log?tail-lines=3")
+		if want, got := "b\nc\nd\n", httpGET(t, tu); want != got {
+			t.Errorf("want last 3 lines %q, got %q", want, got)
+		}
+		tu, _ = url.Parse(server.URL + "/log?tail-bytes=100")
+		if want, got := "a\nb\nc\nd\n", httpGET(t, tu); want != got {
+			t.Errorf("want whole file %q, got %q", want, got)
+		}
+		r, err := FollowTail(u, 1, true)
+		if err != nil {
+			t.Fatalf("FollowTail: %s", err)
+		}
+		if want, got := "d\n", string(readAll(t, r)); want != got {
+			t.Errorf("want last line %q, got %q", want, got)
+		}
+
+		lines.Close()
+		lastBytes.Close()
+		r.Close()
+		server.close()
+	}
+}
@@ -0,0 +1,170 @@
+package httpfstream
+
+import (
+	"encoding/json"
+	"github.com/garyburd/go-websocket/websocket"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A StreamEvent reports a change to a stream, to clients that WATCH a path.
+type StreamEvent struct {
+	// Type is "writing" when a writer starts appending to the stream,
+	// "created" when the writer creates the stream's file (after the
+	// "writing" event), "finished" when the writer finishes, or "deleted" or
+	// "rotated" when the stream is deleted or rotated.
+	Type string `json:"type"`
+
+	Path string `json:"path"`
+
+	// Aborted and Reason describe how a "finished" stream ended, as for
+	// AbortError.
+	Aborted bool   `json:"aborted,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// watchChanSize is the number of events that may be queued for a watcher. A
+// watcher that falls further behind is disconnected.
+const watchChanSize = 64
+
+// addWatcher registers c to receive events for the streams at or under path.
+func (h Handler) addWatcher(path string, c chan StreamEvent) {
+	h.watchersMu.Lock()
+	defer h.watchersMu.Unlock()
+	h.watchers[c] = path
+}
+
+func (h Handler) removeWatcher(c chan StreamEvent) {
+	h.watchersMu.Lock()
+	defer h.watchersMu.Unlock()
+	delete(h.watchers, c)
+}
+
+// notify sends e to the watchers of its path, without blocking. The channel of
+// a watcher whose queue is full is removed and closed.
+func (h Handler) notify(e StreamEvent) {
+	h.watchersMu.Lock()
+	defer h.watchersMu.Unlock()
+	for c, dir := range h.watchers {
+		if !isUnder(e.Path, dir) {
+			continue
+		}
+		select {
+		case c <- e:
+		default:
+			h.logWarn("Watcher fell behind; disconnecting", "path", dir)
+			delete(h.watchers, c)
+			close(c)
+		}
+	}
+}
+
+// isUnder reports whether path is dir or is in the tree under dir.
+func isUnder(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// Watch handles WATCH requests, which receive a StreamEvent (as JSON) whenever
+// a stream at or under the requested path gets a writer, is created, finishes,
+// or is deleted or rotated. Events are sent in WebSocket text messages or, to
+// clients that send "Accept: text/event-stream", as Server-Sent Events. If
+// h.Authorizer is set, the request must be allowed to FOLLOW the requested
+// path, and events for streams that it may not FOLLOW are omitted.
+func (h Handler) Watch(w http.ResponseWriter, r *http.Request) {
+	path := h.resolve(r.URL.Path)
+	h.logDebug("Request started", "verb", "WATCH", "path", path, "remote_addr", r.RemoteAddr)
+
+	if !h.authorize(w, r, "FOLLOW", path) {
+		return
+	}
+	if isStatusPath(path) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var send func(data []byte) error
+	var keepalive func() error
+	var done <-chan struct{}
+	if acceptsEventStream(r) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		s := &eventStreamSink{w, flusher}
+		w.Header().Set("Content-Type", eventStreamType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		send = func(data []byte) error { return s.send([]byte("data: " + string(data) + "\n\n")) }
+		keepalive = s.keepalive
+		done = r.Context().Done()
+	} else {
+		ws, err := websocket.Upgrade(w, r.Header, nil, readBufSize, writeBufSize)
+		if err != nil {
+			if _, ok := err.(websocket.HandshakeError); ok {
+				http.Error(w, "WATCH requires a WebSocket or Server-Sent Events", http.StatusBadRequest)
+				return
+			}
+			h.logWarn("Failed to upgrade to WebSocket", "verb", "WATCH", "path", path, "error", err)
+			return
+		}
+		defer ws.Close()
+		send = func(data []byte) error {
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			return ws.WriteMessage(websocket.OpText, data)
+		}
+		keepalive = func() error {
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			return ws.WriteMessage(websocket.OpPing, []byte{})
+		}
+
+		// Read (and discard) messages from the client until it closes the
+		// connection.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := ws.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		done = closed
+	}
+
+	c := make(chan StreamEvent, watchChanSize)
+	h.addWatcher(path, c)
+	defer h.removeWatcher(c)
+
+	ticker := time.NewTicker(followKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-c:
+			if !ok {
+				return
+			}
+			if h.Authorizer != nil && h.Authorizer.Authorize(r, "FOLLOW", e.Path) != nil {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				h.logError("Failed to encode event", "path", path, "error", err)
+				return
+			}
+			if err := send(data); err != nil {
+				h.logWarn("Write to watcher failed", "path", path, "error", err)
+				return
+			}
+		case <-ticker.C:
+			if err := keepalive(); err != nil {
+				h.logWarn("Keepalive to watcher failed", "path", path, "error", err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package httpfstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	u, _ := url.Parse(server.URL + "/builds")
+	ws, resp, err := DefaultClient.open(context.Background(), u, "WATCH", nil)
+	if err != nil {
+		t.Fatalf("WATCH: %s (%v)", err, resp)
+	}
+	defer ws.Close()
+	waitForWrite()
+
+	nextEvent := func() StreamEvent {
+		_, rd, err := ws.NextReader()
+		if err != nil {
+			t.Fatalf("NextReader: %s", err)
+		}
+		var e StreamEvent
+		if err := json.NewDecoder(rd).Decode(&e); err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		return e
+	}
+
+	// Streams outside of the watched path are ignored.
+	other, _ := url.Parse(server.URL + "/other")
+	w, err := OpenAppend(other)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	w.Close()
+
+	b1, _ := url.Parse(server.URL + "/builds/1")
+	w, err = OpenAppend(b1)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	io.WriteString(w, "foo")
+	for _, want := range []StreamEvent{{Type: "writing", Path: "/builds/1"}, {Type: "created", Path: "/builds/1"}} {
+		if e := nextEvent(); e != want {
+			t.Errorf("want event %+v, got %+v", want, e)
+		}
+	}
+	w.Abort("oops")
+	if want, e := (StreamEvent{Type: "finished", Path: "/builds/1", Aborted: true, Reason: "oops"}), nextEvent(); e != want {
+		t.Errorf("want event %+v, got %+v", want, e)
+	}
+
+	// Appending to an existing stream doesn't create it.
+	w, err = OpenAppend(b1)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	w.Close()
+	for _, want := range []StreamEvent{{Type: "writing", Path: "/builds/1"}, {Type: "finished", Path: "/builds/1"}} {
+		if e := nextEvent(); e != want {
+			t.Errorf("want event %+v, got %+v", want, e)
+		}
+	}
+}
+
+func TestWatch_events(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/?verb=WATCH", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("WATCH: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("want Content-Type text/event-stream, got %q", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+
+	u, _ := url.Parse(server.URL + "/file")
+	w, err := OpenAppend(u)
+	if err != nil {
+		t.Fatalf("OpenAppend: %s", err)
+	}
+	w.Close()
+	for _, want := range []string{
+		`{"type":"writing","path":"/file"}`,
+		`{"type":"created","path":"/file"}`,
+		`{"type":"finished","path":"/file"}`,
+	} {
+		if e := readEvent(t, br); e.typ != "message" || e.data != want {
+			t.Errorf("want event data %s, got %+v", want, e)
+		}
+	}
+}
+
+func TestWatch_notWebSocket(t *testing.T) {
+	t.Parallel()
+	server := newTestServer()
+	defer server.close()
+
+	resp, err := http.Get(server.URL + "/?verb=WATCH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want HTTP status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestNotify_slowWatcher(t *testing.T) {
+	h := NewWithStorage(NewMemStorage())
+	c := make(chan StreamEvent, watchChanSize)
+	h.addWatcher("/", c)
+	for i := 0; i <= watchChanSize; i++ {
+		h.notify(StreamEvent{Type: "writing", Path: "/file"})
+	}
+
+	n := 0
+	for range c {
+		n++
+	}
+	if n != watchChanSize {
+		t.Errorf("want %d queued events before the watcher is closed, got %d", watchChanSize, n)
+	}
+	if len(h.watchers) != 0 {
+		t.Errorf("want slow watcher removed, got %d watchers", len(h.watchers))
+	}
+}